@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+
+	"k8s.io/klog"
+)
+
+const (
+	// imdsV2 uses IMDSv2 session tokens, falling back to IMDSv1 when no token can be fetched.
+	imdsV2 = "v2"
+	// imdsV1 only uses IMDSv1 requests.
+	imdsV1 = "v1"
+	// imdsDisabled never calls the instance metadata service, e.g. to run off EC2.
+	imdsDisabled = "disabled"
+
+	imdsTokenTTL    = 6 * time.Hour
+	imdsTokenHeader = "X-aws-ec2-metadata-token"
+)
+
+// awsOptions configures the AWS client of the ebs-tagger. Empty values keep the SDK defaults.
+type awsOptions struct {
+	region      string
+	ec2Endpoint string
+	stsEndpoint string
+	imds        string
+	profile     string
+
+	// roleARN and webIdentityTokenFile assume a role with a web identity token, e.g. the
+	// projected service account token of IAM roles for service accounts.
+	roleARN              string
+	webIdentityTokenFile string
+
+	maxRetries     int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+}
+
+// validate checks the AWS options.
+func (o awsOptions) validate() error {
+	switch o.imds {
+	case imdsV2, imdsV1, imdsDisabled:
+	default:
+		return fmt.Errorf("unsupported aws-imds mode %q", o.imds)
+	}
+	if (o.roleARN == "") != (o.webIdentityTokenFile == "") {
+		return errors.New("both aws-role-arn and aws-web-identity-token-file must be set to assume a role with a web identity")
+	}
+	if o.profile != "" && o.roleARN != "" {
+		return errors.New("aws-profile and aws-role-arn cannot be set together")
+	}
+	if o.maxRetries < 0 {
+		return fmt.Errorf("invalid aws-max-retries %d", o.maxRetries)
+	}
+	if o.retryBaseDelay <= 0 || o.retryMaxDelay < o.retryBaseDelay {
+		return fmt.Errorf("invalid AWS retry delays: base %v, max %v", o.retryBaseDelay, o.retryMaxDelay)
+	}
+	return nil
+}
+
+// newAWSSession returns a session with the credentials, region and retries of the options. The
+// region is taken from the options, then from the environment or the shared config, then from
+// the instance metadata service.
+func newAWSSession(options awsOptions) (*session.Session, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	config := aws.Config{}
+	if options.region != "" {
+		config.Region = aws.String(options.region)
+	}
+	request.WithRetryer(&config, backoffRetryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: options.maxRetries},
+		baseDelay:      options.retryBaseDelay,
+		maxDelay:       options.retryMaxDelay,
+	})
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		Profile:           options.profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+
+	var metadata *ec2metadata.EC2Metadata
+	if options.imds != imdsDisabled {
+		metadata = ec2metadata.New(sess)
+		if options.imds == imdsV2 {
+			tokens := &imdsTokenProvider{endpoint: metadata.Endpoint}
+			metadata.Handlers.Build.PushBack(tokens.setToken)
+		}
+	}
+
+	// A profile may assume a role through the shared config, which only the default
+	// credentials of the session support.
+	if options.profile == "" {
+		var provider credentials.Provider
+		if options.roleARN != "" {
+			provider = &webIdentityProvider{
+				client:      sts.New(sess, stsConfig(options)),
+				roleARN:     options.roleARN,
+				tokenFile:   options.webIdentityTokenFile,
+				sessionName: eventComponent,
+			}
+		} else {
+			providers := []credentials.Provider{
+				&credentials.EnvProvider{},
+				&credentials.SharedCredentialsProvider{},
+			}
+			if metadata != nil {
+				providers = append(providers, &ec2rolecreds.EC2RoleProvider{Client: metadata})
+			}
+			provider = &credentials.ChainProvider{Providers: providers, VerboseErrors: true}
+		}
+		sess.Config.Credentials = credentials.NewCredentials(provider)
+	}
+
+	if aws.StringValue(sess.Config.Region) == "" {
+		if metadata == nil {
+			return nil, errors.New("AWS region not set, use aws-region or AWS_REGION")
+		}
+		region, err := metadata.Region()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the AWS region from the instance metadata: %v", err)
+		}
+		sess.Config.Region = aws.String(region)
+	}
+
+	return sess, nil
+}
+
+// stsConfig returns the configuration of the STS client.
+func stsConfig(options awsOptions) *aws.Config {
+	config := &aws.Config{}
+	if options.stsEndpoint != "" {
+		config.Endpoint = aws.String(options.stsEndpoint)
+	}
+	return config
+}
+
+// logCallerIdentity logs the AWS identity the ebs-tagger runs as. Failing to resolve it is not
+// fatal, as the STS endpoint may be unreachable while EC2 is not, e.g. with a stand-in.
+func logCallerIdentity(sess *session.Session, options awsOptions) {
+	identity, err := sts.New(sess, stsConfig(options)).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		klog.Warningf("Failed to resolve the AWS identity: %v", err)
+		return
+	}
+	klog.Infof("Using AWS identity %s (account %s) in region %s", aws.StringValue(identity.Arn), aws.StringValue(identity.Account), aws.StringValue(sess.Config.Region))
+}
+
+// backoffRetryer retries the AWS requests the SDK considers retryable, with an exponential
+// backoff and jitter between baseDelay and maxDelay.
+type backoffRetryer struct {
+	client.DefaultRetryer
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+func (r backoffRetryer) RetryRules(req *request.Request) time.Duration {
+	delay := r.maxDelay
+	if req.RetryCount < 30 {
+		if d := r.baseDelay << uint(req.RetryCount); d > 0 && d < r.maxDelay {
+			delay = d
+		}
+	}
+	// Half of the delay is randomized so that replicas do not retry in sync.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// imdsTokenProvider adds an IMDSv2 session token to the requests of an EC2 metadata client. The
+// SDK version in use only issues IMDSv1 requests, which instances requiring IMDSv2 reject.
+type imdsTokenProvider struct {
+	endpoint string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (p *imdsTokenProvider) setToken(r *request.Request) {
+	token, err := p.get()
+	if err != nil {
+		klog.V(4).Infof("Falling back to IMDSv1: %v", err)
+		return
+	}
+	r.HTTPRequest.Header.Set(imdsTokenHeader, token)
+}
+
+func (p *imdsTokenProvider) get() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Now().Before(p.expiry) {
+		return p.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(p.endpoint, "/")+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", fmt.Sprintf("%d", int(imdsTokenTTL.Seconds())))
+	resp, err := (&http.Client{Timeout: time.Second}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch an IMDSv2 token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch an IMDSv2 token: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	p.token = string(body)
+	// Renew the token before it expires.
+	p.expiry = time.Now().Add(imdsTokenTTL - time.Minute)
+	return p.token, nil
+}
+
+// webIdentityProvider assumes a role with the web identity token of a file, which is read again
+// each time the credentials expire, as the token is rotated.
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client      stsiface.STSAPI
+	roleARN     string
+	tokenFile   string
+	sessionName string
+}
+
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to read the web identity token: %v", err)
+	}
+	resp, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to assume role %s with a web identity: %v", p.roleARN, err)
+	}
+	p.SetExpiration(aws.TimeValue(resp.Credentials.Expiration), time.Minute)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(resp.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(resp.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(resp.Credentials.SessionToken),
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
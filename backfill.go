@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"k8s.io/klog"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/pager"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// checkpointInterval is the number of objects processed between two checkpoint saves.
+	checkpointInterval = 100
+
+	checkpointConfigHashKey = "configHash"
+	checkpointCompleteKey   = "complete"
+)
+
+// backfillOptions configures a backfill run.
+type backfillOptions struct {
+	// namespaces to backfill, all namespaces if empty.
+	namespaces []string
+	// kinds to backfill, among the supported kinds.
+	kinds    []string
+	qps      float32
+	burst    int
+	pageSize int64
+	dryRun   bool
+	// checkpointNamespace/checkpointName identify the ConfigMap storing the progress of the
+	// backfill, so that an interrupted run resumes where it stopped. Disabled if the name is empty.
+	checkpointNamespace string
+	checkpointName      string
+}
+
+// backfillStats counts the objects handled by a backfill run for a single kind.
+type backfillStats struct {
+	scanned  int
+	patched  int
+	upToDate int
+	skipped  map[string]int
+	failed   int
+}
+
+// backfiller patches the objects that existed before the k8s-metadata-injector was installed,
+// or before their namespace was configured, with the same policy used on admission.
+type backfiller struct {
+	clientset  kubernetes.Interface
+	config     *MetadataConfig
+	options    backfillOptions
+	limiter    flowcontrol.RateLimiter
+	checkpoint *corev1.ConfigMap
+	stats      map[string]*backfillStats
+	// namespaceLabels holds the labels of all namespaces, listed once at start.
+	namespaceLabels map[string]map[string]string
+}
+
+func runBackfill(ctx context.Context, clientset kubernetes.Interface, config *MetadataConfig, options backfillOptions) error {
+	b := &backfiller{
+		clientset: clientset,
+		config:    config,
+		options:   options,
+		limiter:   flowcontrol.NewTokenBucketRateLimiter(options.qps, options.burst),
+		stats:     map[string]*backfillStats{},
+	}
+
+	for _, kind := range options.kinds {
+		if resourceForKind(kind) == "" {
+			return fmt.Errorf("unsupported kind %q", kind)
+		}
+	}
+
+	if err := b.loadCheckpoint(); err != nil {
+		return err
+	}
+
+	if err := b.loadNamespaceLabels(); err != nil {
+		return err
+	}
+
+	// Objects are listed in key order, so namespaces are sorted to make the checkpoint meaningful.
+	namespaces := append([]string{}, options.namespaces...)
+	sort.Strings(namespaces)
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	var err error
+	for _, kind := range options.kinds {
+		if b.checkpoint != nil && b.checkpoint.Data[kind+"."+checkpointCompleteKey] == "true" {
+			klog.Infof("Skipping %s, already backfilled according to the checkpoint", kind)
+			continue
+		}
+		for _, namespace := range namespaces {
+			if err = b.backfill(ctx, kind, namespace); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		// A kind with failed objects is not complete, the next run retries them.
+		if b.stats[kind].failed > 0 {
+			continue
+		}
+		b.setCheckpoint(kind+"."+checkpointCompleteKey, "true")
+		if err = b.saveCheckpoint(); err != nil {
+			break
+		}
+	}
+
+	b.printReport()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, stats := range b.stats {
+		failed += stats.failed
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to patch %d objects, run the backfill again to retry them", failed)
+	}
+
+	// The checkpoint is only kept for interrupted or failed runs.
+	if b.checkpoint != nil {
+		return b.clientset.CoreV1().ConfigMaps(b.checkpoint.Namespace).Delete(b.checkpoint.Name, &metav1.DeleteOptions{})
+	}
+	return nil
+}
+
+func (b *backfiller) backfill(ctx context.Context, kind string, namespace string) error {
+	stats, ok := b.stats[kind]
+	if !ok {
+		stats = &backfillStats{skipped: map[string]int{}}
+		b.stats[kind] = stats
+	}
+
+	var last string
+	if b.checkpoint != nil {
+		last = b.checkpoint.Data[kind]
+	}
+
+	p := pager.New(pager.SimplePageFunc(b.listFunc(kind, namespace)))
+	p.PageSize = b.options.pageSize
+
+	processed := 0
+	err := p.EachListItem(ctx, metav1.ListOptions{}, func(obj runtime.Object) error {
+		metadata := objectMeta(obj)
+		if metadata == nil {
+			return nil
+		}
+		key := metadata.Namespace + "/" + metadata.Name
+		if key <= last {
+			return nil
+		}
+
+		stats.scanned++
+		b.patchObject(kind, metadata, stats)
+
+		// The checkpoint only moves past objects as long as none of this kind failed, so that
+		// the next run starts again from the first failed object.
+		if stats.failed == 0 {
+			b.setCheckpoint(kind, key)
+		}
+		processed++
+		if processed%checkpointInterval == 0 {
+			return b.saveCheckpoint()
+		}
+		return nil
+	})
+	if saveErr := b.saveCheckpoint(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+func (b *backfiller) patchObject(kind string, metadata *metav1.ObjectMeta, stats *backfillStats) {
+	update, reason := b.config.planMetadataUpdate(kind, metadata, b.namespaceLabels[metadata.Namespace], true)
+	if update == nil {
+		stats.skipped[reason]++
+		return
+	}
+	if update.empty() {
+		stats.upToDate++
+		return
+	}
+
+	data, err := update.mergePatch()
+	if err != nil {
+		klog.Errorf("Failed to create patch for %s %s/%s: %v", kind, metadata.Namespace, metadata.Name, err)
+		stats.failed++
+		return
+	}
+
+	if b.options.dryRun {
+		klog.Infof("[dry-run] Would patch %s %s/%s: %s", kind, metadata.Namespace, metadata.Name, string(data))
+		stats.patched++
+		return
+	}
+
+	b.limiter.Accept()
+	if err := patchMetadata(b.clientset, kind, metadata.Namespace, metadata.Name, data); err != nil {
+		if errors.IsNotFound(err) {
+			return
+		}
+		klog.Errorf("Failed to patch %s %s/%s: %v", kind, metadata.Namespace, metadata.Name, err)
+		stats.failed++
+		return
+	}
+	klog.V(2).Infof("Patched %s %s/%s: %s", kind, metadata.Namespace, metadata.Name, string(data))
+	stats.patched++
+}
+
+func (b *backfiller) listFunc(kind string, namespace string) func(opts metav1.ListOptions) (runtime.Object, error) {
+	return func(opts metav1.ListOptions) (runtime.Object, error) {
+		b.limiter.Accept()
+		switch kind {
+		case kindPod:
+			return b.clientset.CoreV1().Pods(namespace).List(opts)
+		case kindService:
+			return b.clientset.CoreV1().Services(namespace).List(opts)
+		case kindPersistentVolumeClaim:
+			return b.clientset.CoreV1().PersistentVolumeClaims(namespace).List(opts)
+		}
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+}
+
+func (b *backfiller) loadNamespaceLabels() error {
+	b.limiter.Accept()
+	namespaces, err := b.clientset.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	b.namespaceLabels = map[string]map[string]string{}
+	for _, namespace := range namespaces.Items {
+		b.namespaceLabels[namespace.Name] = namespace.Labels
+	}
+	return nil
+}
+
+// loadCheckpoint reads the checkpoint ConfigMap, discarding it if it was written for
+// another revision of the metadata configuration.
+func (b *backfiller) loadCheckpoint() error {
+	if b.options.checkpointName == "" || b.options.dryRun {
+		return nil
+	}
+
+	client := b.clientset.CoreV1().ConfigMaps(b.options.checkpointNamespace)
+	checkpoint, err := client.Get(b.options.checkpointName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		checkpoint = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      b.options.checkpointName,
+				Namespace: b.options.checkpointNamespace,
+			},
+		}
+		if checkpoint, err = client.Create(checkpoint); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if checkpoint.Data[checkpointConfigHashKey] != b.config.hash {
+		if len(checkpoint.Data) > 0 {
+			klog.Infof("Metadata configuration changed since the last backfill, starting over")
+		}
+		checkpoint.Data = map[string]string{checkpointConfigHashKey: b.config.hash}
+	} else {
+		klog.Infof("Resuming backfill from checkpoint %s/%s", checkpoint.Namespace, checkpoint.Name)
+	}
+	b.checkpoint = checkpoint
+	return nil
+}
+
+func (b *backfiller) setCheckpoint(key string, value string) {
+	if b.checkpoint != nil {
+		b.checkpoint.Data[key] = value
+	}
+}
+
+func (b *backfiller) saveCheckpoint() error {
+	if b.checkpoint == nil {
+		return nil
+	}
+	checkpoint, err := b.clientset.CoreV1().ConfigMaps(b.checkpoint.Namespace).Update(b.checkpoint)
+	if err != nil {
+		return fmt.Errorf("failed to save backfill checkpoint: %v", err)
+	}
+	b.checkpoint = checkpoint
+	return nil
+}
+
+func (b *backfiller) printReport() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	patched := "PATCHED"
+	if b.options.dryRun {
+		patched = "WOULD PATCH"
+	}
+	fmt.Fprintf(w, "KIND\tSCANNED\t%s\tUP TO DATE\tSKIPPED\tFAILED\n", patched)
+	for _, kind := range b.options.kinds {
+		stats, ok := b.stats[kind]
+		if !ok {
+			continue
+		}
+		skipped := 0
+		for _, n := range stats.skipped {
+			skipped += n
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", kind, stats.scanned, stats.patched, stats.upToDate, skipped, stats.failed)
+	}
+	w.Flush()
+
+	for _, kind := range b.options.kinds {
+		if stats, ok := b.stats[kind]; ok {
+			for reason, n := range stats.skipped {
+				fmt.Printf("%s skipped (%s): %d\n", kind, reason, n)
+			}
+		}
+	}
+}
+
+// objectMeta returns the metadata of a supported object.
+func objectMeta(obj runtime.Object) *metav1.ObjectMeta {
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		return &o.ObjectMeta
+	case *corev1.Service:
+		return &o.ObjectMeta
+	case *corev1.PersistentVolumeClaim:
+		return &o.ObjectMeta
+	}
+	return nil
+}
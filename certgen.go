@@ -0,0 +1,483 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	certificatesv1beta1 "k8s.io/api/certificates/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	certBootstrapSelfSigned = "self-signed"
+	certBootstrapCSR        = "csr"
+
+	caKeyFile = "ca-key.pem"
+	// nextCACertFile and nextCAKeyFile hold the CA replacing the current one, published in the CA
+	// bundle before it signs the serving certificate.
+	nextCACertFile = "next-ca-cert.pem"
+	nextCAKeyFile  = "next-ca-key.pem"
+
+	caValidity      = 10 * 365 * 24 * time.Hour
+	servingValidity = 365 * 24 * time.Hour
+)
+
+// certIssuer issues serving certificates for the webhook server.
+type certIssuer interface {
+	// Issue returns the certificate files for the given DNS names, keyed by file name. previous
+	// holds the files being renewed, or is nil when bootstrapping.
+	Issue(dnsNames []string, previous map[string][]byte) (map[string][]byte, error)
+}
+
+// caRotator is implemented by the issuers managing their own CA, which issue the serving
+// certificate again once a new CA is trusted by the API server.
+type caRotator interface {
+	// rotationReason returns why the serving certificate has to be signed by a new CA, or an
+	// empty string.
+	rotationReason(previous map[string][]byte) string
+}
+
+// bootstrapCertSource issues the certificates of the webhook server and stores them in a Secret
+// shared by all replicas, renewing them before they expire. Replicas racing to create or renew
+// the Secret use the one stored by the first.
+type bootstrapCertSource struct {
+	clientset   kubernetes.Interface
+	namespace   string
+	name        string
+	dnsNames    []string
+	renewBefore time.Duration
+	issuer      certIssuer
+}
+
+func (s *bootstrapCertSource) Load() (*certData, error) {
+	client := s.clientset.CoreV1().Secrets(s.namespace)
+	secret, err := client.Get(s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		glog.Infof("Issuing the webhook certificate for %v", s.dnsNames)
+		data, err := s.issuer.Issue(s.dnsNames, nil)
+		if err != nil {
+			return nil, err
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.name,
+				Namespace: s.namespace,
+			},
+			Data: data,
+		}
+		created, err := client.Create(secret)
+		if apierrors.IsAlreadyExists(err) {
+			// Another replica created it first.
+			return s.Load()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return certDataFromSecret(created)
+	} else if err != nil {
+		return nil, err
+	}
+
+	reason := renewalReason(secret.Data[serverCertFile], s.dnsNames, s.renewBefore)
+	if rotator, ok := s.issuer.(caRotator); ok && reason == "" {
+		reason = rotator.rotationReason(secret.Data)
+	}
+	if reason == "" {
+		return certDataFromSecret(secret)
+	}
+
+	glog.Infof("Renewing the webhook certificate: %s", reason)
+	data, err := s.issuer.Issue(s.dnsNames, secret.Data)
+	if err != nil {
+		return nil, err
+	}
+	secret.Data = data
+	updated, err := client.Update(secret)
+	if apierrors.IsConflict(err) {
+		// Another replica renewed it first.
+		return s.Load()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return certDataFromSecret(updated)
+}
+
+// Watch reports the changes of the Secret, e.g. a certificate renewed by another replica.
+func (s *bootstrapCertSource) Watch(changed func(), stopCh <-chan struct{}) error {
+	watchSecret(s.clientset, s.namespace, s.name, changed, stopCh)
+	return nil
+}
+
+// renewalReason returns why the serving certificate has to be issued again, or an empty string
+// if it is still valid for the given DNS names for longer than renewBefore.
+func renewalReason(certPEM []byte, dnsNames []string, renewBefore time.Duration) string {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return err.Error()
+	}
+	if time.Now().Add(renewBefore).After(cert.NotAfter) {
+		return fmt.Sprintf("certificate expires at %v", cert.NotAfter)
+	}
+	for _, name := range dnsNames {
+		if err := cert.VerifyHostname(name); err != nil {
+			return fmt.Sprintf("certificate not valid for %s", name)
+		}
+	}
+	return ""
+}
+
+// selfSignedIssuer signs serving certificates with a CA generated on first use and stored along
+// with them. The CA is replaced in two steps when it would expire before the serving
+// certificate: the new CA is first added to the CA bundle while the current one keeps signing,
+// and only signs the serving certificate once published reports that the API server trusts it.
+// The previous CA is kept in the CA bundle as long as it is valid.
+type selfSignedIssuer struct {
+	commonName string
+	// published reports whether the registered webhooks trust a CA certificate. Without it, a
+	// new CA signs the serving certificate right away.
+	published func(caCert []byte) bool
+}
+
+func (i *selfSignedIssuer) rotationReason(previous map[string][]byte) string {
+	if len(previous[nextCACertFile]) > 0 && i.isPublished(previous[nextCACertFile]) {
+		return "the new webhook CA is trusted by the API server"
+	}
+	return ""
+}
+
+func (i *selfSignedIssuer) isPublished(caCert []byte) bool {
+	return i.published == nil || i.published(caCert)
+}
+
+func (i *selfSignedIssuer) Issue(dnsNames []string, previous map[string][]byte) (map[string][]byte, error) {
+	now := time.Now()
+	notAfter := now.Add(servingValidity)
+
+	caBundle := previous[caCertFile]
+	ca, caErr := parseCertificatePEM(caBundle)
+	caKey, keyErr := parsePrivateKeyPEM(previous[caKeyFile])
+	nextCA, nextCAErr := parseCertificatePEM(previous[nextCACertFile])
+	nextCAKey, nextKeyErr := parsePrivateKeyPEM(previous[nextCAKeyFile])
+	pending := nextCAErr == nil && nextKeyErr == nil
+
+	switch {
+	case caErr != nil || keyErr != nil || !now.Before(ca.NotAfter):
+		// Without a valid CA, the current bundle cannot be trusted anyway.
+		glog.Infof("Generating a new webhook CA")
+		var err error
+		ca, caKey, err = newCA(i.commonName + "_ca")
+		if err != nil {
+			return nil, err
+		}
+		caBundle = pemEncode("CERTIFICATE", ca.Raw)
+		pending = false
+	case pending && i.isPublished(previous[nextCACertFile]):
+		glog.Infof("Signing the webhook certificate with the new webhook CA")
+		caBundle = append(pemEncode("CERTIFICATE", nextCA.Raw), pemEncode("CERTIFICATE", ca.Raw)...)
+		ca, caKey = nextCA, nextCAKey
+		pending = false
+	case !pending && ca.NotAfter.Before(notAfter):
+		glog.Infof("Generating a new webhook CA, published in the CA bundle before it signs the webhook certificate")
+		var err error
+		nextCA, nextCAKey, err = newCA(i.commonName + "_ca")
+		if err != nil {
+			return nil, err
+		}
+		caBundle = append(append([]byte{}, caBundle...), pemEncode("CERTIFICATE", nextCA.Raw)...)
+		pending = true
+	}
+	// The serving certificate cannot outlive the CA signing it.
+	if ca.NotAfter.Before(notAfter) {
+		notAfter = ca.NotAfter
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := servingCertTemplate(i.commonName, dnsNames, notAfter)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	caKeyPEM, err := encodePrivateKey(caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{
+		caCertFile:     caBundle,
+		caKeyFile:      caKeyPEM,
+		serverCertFile: pemEncode("CERTIFICATE", der),
+		serverKeyFile:  pemEncode("EC PRIVATE KEY", keyDER),
+	}
+	if pending {
+		nextCAKeyPEM, err := encodePrivateKey(nextCAKey)
+		if err != nil {
+			return nil, err
+		}
+		files[nextCACertFile] = pemEncode("CERTIFICATE", nextCA.Raw)
+		files[nextCAKeyFile] = nextCAKeyPEM
+	}
+	return files, nil
+}
+
+// csrIssuer requests serving certificates through the Kubernetes CertificateSigningRequest API.
+// The requests are approved by a cluster administrator or an external approver, the issuer only
+// waits up to timeout for them to be signed. caBundle is the cluster CA signing them.
+type csrIssuer struct {
+	clientset  kubernetes.Interface
+	commonName string
+	caBundle   []byte
+	timeout    time.Duration
+}
+
+func (i *csrIssuer) Issue(dnsNames []string, previous map[string][]byte) (map[string][]byte, error) {
+	if len(i.caBundle) == 0 {
+		return nil, errors.New("the cluster CA certificate is required to use the CertificateSigningRequest API")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	request, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: i.commonName},
+		DNSNames:    dnsNamesOf(dnsNames),
+		IPAddresses: ipAddressesOf(dnsNames),
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	client := i.clientset.CertificatesV1beta1().CertificateSigningRequests()
+	csr, err := client.Create(&certificatesv1beta1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "k8s-metadata-injector-",
+		},
+		Spec: certificatesv1beta1.CertificateSigningRequestSpec{
+			Request: pemEncode("CERTIFICATE REQUEST", request),
+			Usages: []certificatesv1beta1.KeyUsage{
+				certificatesv1beta1.UsageDigitalSignature,
+				certificatesv1beta1.UsageKeyEncipherment,
+				certificatesv1beta1.UsageServerAuth,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := client.Delete(csr.Name, &metav1.DeleteOptions{}); err != nil {
+			glog.Errorf("Failed to delete CertificateSigningRequest %s: %v", csr.Name, err)
+		}
+	}()
+
+	glog.Infof("Waiting up to %v for CertificateSigningRequest %s to be approved, e.g. with: kubectl certificate approve %s", i.timeout, csr.Name, csr.Name)
+
+	var certPEM []byte
+	err = wait.PollImmediate(time.Second, i.timeout, func() (bool, error) {
+		current, err := client.Get(csr.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, condition := range current.Status.Conditions {
+			if condition.Type == certificatesv1beta1.CertificateDenied {
+				return false, fmt.Errorf("CertificateSigningRequest %s denied: %s", csr.Name, condition.Message)
+			}
+		}
+		certPEM = current.Status.Certificate
+		return len(certPEM) > 0, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CertificateSigningRequest %s signed: %v", csr.Name, err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		caCertFile:     i.caBundle,
+		serverCertFile: certPEM,
+		serverKeyFile:  pemEncode("EC PRIVATE KEY", keyDER),
+	}, nil
+}
+
+// memoryCertSource serves a self-signed certificate generated in memory at startup, for running
+// outside of the cluster during development. A new CA is generated on every start and
+// registered with the webhook.
+type memoryCertSource struct {
+	data *certData
+}
+
+func newMemoryCertSource(hostNames []string) (*memoryCertSource, error) {
+	files, err := (&selfSignedIssuer{commonName: hostNames[0]}).Issue(hostNames, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryCertSource{
+		data: &certData{
+			serverCert: files[serverCertFile],
+			serverKey:  files[serverKeyFile],
+			caCert:     files[caCertFile],
+		},
+	}, nil
+}
+
+func (s *memoryCertSource) Load() (*certData, error) {
+	return s.data, nil
+}
+
+// serviceDNSNames returns the DNS names the API server may use to reach the webhook service.
+func serviceDNSNames(service string, namespace string) []string {
+	return []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+	}
+}
+
+// dnsNamesOf returns the names that are not IP addresses.
+func dnsNamesOf(names []string) []string {
+	var dnsNames []string
+	for _, name := range names {
+		if net.ParseIP(name) == nil {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	return dnsNames
+}
+
+// ipAddressesOf returns the names that are IP addresses, e.g. the host of a webhook URL.
+func ipAddressesOf(names []string) []net.IP {
+	var ips []net.IP
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func newCA(commonName string) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func servingCertTemplate(commonName string, dnsNames []string, notAfter time.Time) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNamesOf(dnsNames),
+		IPAddresses:  ipAddressesOf(dnsNames),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil
+}
+
+func pemEncode(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+// parseCertificatePEM parses the first certificate of a PEM bundle.
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// parsePrivateKeyPEM parses a PKCS#1, SEC 1 or PKCS#8 PEM private key, as written by
+// hack/gencerts.sh or by the selfSignedIssuer.
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pemEncode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(k)), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pemEncode("EC PRIVATE KEY", der), nil
+	}
+	return nil, errors.New("unsupported private key type")
+}
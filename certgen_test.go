@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenewalReason(t *testing.T) {
+	files, err := (&selfSignedIssuer{commonName: "webhook"}).Issue([]string{"webhook", "webhook.default.svc"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := files[serverCertFile]
+
+	tests := []struct {
+		name        string
+		cert        []byte
+		dnsNames    []string
+		renewBefore time.Duration
+		want        string
+	}{
+		{name: "valid", cert: cert, dnsNames: []string{"webhook", "webhook.default.svc"}, renewBefore: 24 * time.Hour},
+		{name: "missing", want: "no PEM certificate found"},
+		{name: "expiring", cert: cert, dnsNames: []string{"webhook"}, renewBefore: 2 * servingValidity, want: "certificate expires at"},
+		{name: "other name", cert: cert, dnsNames: []string{"webhook.other.svc"}, want: "certificate not valid for webhook.other.svc"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := renewalReason(test.cert, test.dnsNames, test.renewBefore)
+			if (test.want == "") != (got == "") || !strings.HasPrefix(got, test.want) {
+				t.Errorf("renewalReason() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// verifyServingCert checks that the serving certificate of files is trusted by caBundle.
+func verifyServingCert(t *testing.T, files map[string][]byte, caBundle []byte) error {
+	t.Helper()
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caBundle) {
+		t.Fatal("invalid CA bundle")
+	}
+	cert, err := parseCertificatePEM(files[serverCertFile])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{DNSName: "webhook", Roots: roots})
+	return err
+}
+
+func TestSelfSignedIssuerRotatesCA(t *testing.T) {
+	published := false
+	issuer := &selfSignedIssuer{
+		commonName: "webhook",
+		published:  func([]byte) bool { return published },
+	}
+
+	initial, err := issuer.Issue([]string{"webhook"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyServingCert(t, initial, initial[caCertFile]); err != nil {
+		t.Fatalf("initial certificate not trusted: %v", err)
+	}
+	if issuer.rotationReason(initial) != "" || len(initial[nextCACertFile]) > 0 {
+		t.Fatal("unexpected CA rotation after bootstrap")
+	}
+
+	// Renewing with a valid CA keeps it.
+	renewed, err := issuer.Issue([]string{"webhook"}, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(renewed[caCertFile], initial[caCertFile]) || len(renewed[nextCACertFile]) > 0 {
+		t.Fatal("the CA changed on renewal")
+	}
+
+	// A CA expiring before the serving certificate is first only published.
+	expiring := copyFiles(initial)
+	expiring[caCertFile], expiring[caKeyFile] = newTestCA(t, time.Now().Add(servingValidity/2))
+
+	step1, err := issuer.Issue([]string{"webhook"}, expiring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(step1[nextCACertFile]) == 0 || !bytes.Contains(step1[caCertFile], step1[nextCACertFile]) {
+		t.Fatal("the new CA is not published in the CA bundle")
+	}
+	if err := verifyServingCert(t, step1, expiring[caCertFile]); err != nil {
+		t.Fatalf("the serving certificate is not signed by the current CA before the new one is published: %v", err)
+	}
+	if reason := issuer.rotationReason(step1); reason != "" {
+		t.Fatalf("rotation requested before the new CA is published: %s", reason)
+	}
+
+	// Not published yet, the pending CA is kept.
+	pending, err := issuer.Issue([]string{"webhook"}, step1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pending[nextCACertFile], step1[nextCACertFile]) {
+		t.Fatal("the pending CA changed before it was published")
+	}
+
+	published = true
+	if issuer.rotationReason(pending) == "" {
+		t.Fatal("no rotation requested once the new CA is published")
+	}
+	step2, err := issuer.Issue([]string{"webhook"}, pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(step2[nextCACertFile]) > 0 {
+		t.Fatal("the new CA is still pending after the rotation")
+	}
+	if err := verifyServingCert(t, step2, step1[nextCACertFile]); err != nil {
+		t.Fatalf("the serving certificate is not signed by the new CA: %v", err)
+	}
+	if !bytes.Contains(step2[caCertFile], expiring[caCertFile]) {
+		t.Fatal("the previous CA was removed from the CA bundle before it expired")
+	}
+}
+
+// newTestCA returns a CA certificate expiring at notAfter and its key.
+func newTestCA(t *testing.T, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "webhook_ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pemEncode("CERTIFICATE", der), keyPEM
+}
+
+func copyFiles(files map[string][]byte) map[string][]byte {
+	copied := map[string][]byte{}
+	for name, data := range files {
+		copied[name] = data
+	}
+	return copied
+}
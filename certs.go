@@ -1,10 +1,47 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
+// certData holds the PEM-encoded serving certificate and key of the webhook server, and the
+// CA certificate for the API server to verify the server certificate.
+type certData struct {
+	serverCert []byte
+	serverKey  []byte
+	caCert     []byte
+}
+
+// certSource provides the certificates of the webhook server.
+type certSource interface {
+	Load() (*certData, error)
+}
+
+// certWatcher is implemented by the certificate sources which can report changes, so that a
+// rotated certificate is loaded right away.
+type certWatcher interface {
+	// Watch calls changed whenever the certificate may have changed, until stopCh is closed.
+	Watch(changed func(), stopCh <-chan struct{}) error
+}
+
 // certBundle is a container of a X509 certificate file and a corresponding key file for the
 // webhook server, and a CA certificate file for the API server to verify the server certificate.
 type certBundle struct {
@@ -13,14 +50,323 @@ type certBundle struct {
 	caCertFile     string
 }
 
-// configServerTLS configures TLS for the admission webhook server.
-func configServerTLS(certBundle *certBundle) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certBundle.serverCertFile, certBundle.serverKeyFile)
+func (c *certBundle) Load() (*certData, error) {
+	serverCert, err := readCertFile(c.serverCertFile)
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := readCertFile(c.serverKeyFile)
 	if err != nil {
 		return nil, err
 	}
+	caCert, err := readCertFile(c.caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	return &certData{serverCert: serverCert, serverKey: serverKey, caCert: caCert}, nil
+}
+
+// Watch watches the directories of the certificate files rather than the files themselves, as
+// mounted Secrets are updated by swapping a symlink in their directory.
+func (c *certBundle) Watch(changed func(), stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := map[string]bool{}
+	for _, file := range []string{c.serverCertFile, c.serverKeyFile, c.caCertFile} {
+		dir := filepath.Dir(file)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				glog.V(2).Infof("Webhook certificate files changed: %v", event)
+				changed()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				glog.Errorf("Error watching the webhook certificate files: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// secretCertSource reads the certificates from a Secret, using the file names of a certBundle as keys.
+type secretCertSource struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (s *secretCertSource) Load() (*certData, error) {
+	secret, err := s.clientset.CoreV1().Secrets(s.namespace).Get(s.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return certDataFromSecret(secret)
+}
+
+func (s *secretCertSource) Watch(changed func(), stopCh <-chan struct{}) error {
+	watchSecret(s.clientset, s.namespace, s.name, changed, stopCh)
+	return nil
+}
+
+// watchSecret calls changed whenever the Secret namespace/name is created or updated, until
+// stopCh is closed.
+func watchSecret(clientset kubernetes.Interface, namespace string, name string, changed func(), stopCh <-chan struct{}) {
+	listwatch := cache.NewListWatchFromClient(
+		clientset.CoreV1().RESTClient(),
+		"secrets",
+		namespace,
+		fields.OneTermEqualSelector("metadata.name", name),
+	)
+	// The informer is not resynced, the certReloader reloads the certificate periodically.
+	_, informer := cache.NewInformer(listwatch, &corev1.Secret{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			changed()
+		},
+		UpdateFunc: func(old, new interface{}) {
+			changed()
+		},
+	})
+	go informer.Run(stopCh)
+}
+
+// certDataFromSecret returns the certificates stored in a Secret.
+func certDataFromSecret(secret *corev1.Secret) (*certData, error) {
+	data := &certData{
+		serverCert: secret.Data[serverCertFile],
+		serverKey:  secret.Data[serverKeyFile],
+		caCert:     secret.Data[caCertFile],
+	}
+	if len(data.serverCert) == 0 || len(data.serverKey) == 0 || len(data.caCert) == 0 {
+		return nil, fmt.Errorf("secret %s/%s must contain %s, %s and %s", secret.Namespace, secret.Name, serverCertFile, serverKeyFile, caCertFile)
+	}
+	return data, nil
+}
+
+// certReloader serves the current certificate of the webhook server and reloads it from its
+// source when it changes, so that certificates can be rotated without restarting the pod.
+type certReloader struct {
+	source certSource
+
+	// reloadMu serializes the reloads triggered by the watch and by the periodic reload.
+	reloadMu sync.Mutex
+
+	mu   sync.RWMutex
+	data *certData
+	cert *tls.Certificate
+	leaf *x509.Certificate
+	onCA []func(caCert []byte)
+}
+
+// newCertReloader returns a certReloader with the certificate initially loaded from source.
+func newCertReloader(source certSource) (*certReloader, error) {
+	r := &certReloader{source: source}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// OnCAChange registers a function called with the new CA certificate whenever it changes.
+func (r *certReloader) OnCAChange(fn func(caCert []byte)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onCA = append(r.onCA, fn)
+}
+
+// Run reloads the certificate whenever its source reports a change, until stopCh is closed. It is
+// also reloaded every interval, for the sources which cannot be watched, in case a change is
+// missed, and to renew bootstrapped certificates.
+func (r *certReloader) Run(interval time.Duration, stopCh <-chan struct{}) {
+	reload := func() {
+		if err := r.reload(); err != nil {
+			glog.Errorf("Failed to reload the webhook certificate: %v", err)
+		}
+	}
+	if watcher, ok := r.source.(certWatcher); ok {
+		if err := watcher.Watch(reload, stopCh); err != nil {
+			glog.Errorf("Failed to watch the webhook certificate, reloading it every %v only: %v", interval, err)
+		}
+	}
+	wait.Until(reload, interval, stopCh)
+}
+
+func (r *certReloader) reload() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	data, err := r.source.Load()
+	if err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	current := r.data
+	r.mu.RUnlock()
+	if current != nil && bytes.Equal(current.serverCert, data.serverCert) &&
+		bytes.Equal(current.serverKey, data.serverKey) && bytes.Equal(current.caCert, data.caCert) {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(data.serverCert, data.serverKey)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.data = data
+	r.cert = &cert
+	r.leaf = leaf
+	callbacks := r.onCA
+	r.mu.Unlock()
+
+	glog.Infof("Loaded webhook serving certificate valid until %v", leaf.NotAfter)
+
+	if current != nil && !bytes.Equal(current.caCert, data.caCert) {
+		glog.Info("Webhook CA certificate changed")
+		for _, fn := range callbacks {
+			fn(data.caCert)
+		}
+	}
+	return nil
+}
+
+// GetCertificate returns the current serving certificate, for use in tls.Config.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, errors.New("no serving certificate loaded")
+	}
+	return r.cert, nil
+}
 
-	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+// caBundle returns the current CA certificate.
+func (r *certReloader) caBundle() []byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.data.caCert
+}
+
+// check reports whether a serving certificate is loaded and not expired.
+func (r *certReloader) check() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.leaf == nil {
+		return errors.New("no serving certificate loaded")
+	}
+	if time.Now().After(r.leaf.NotAfter) {
+		return fmt.Errorf("serving certificate expired at %v", r.leaf.NotAfter)
+	}
+	return nil
+}
+
+// tlsVersionNames maps the accepted names of TLS versions, as used by the API server flags.
+var tlsVersionNames = map[string]uint16{
+	"VersionTLS10": tls.VersionTLS10,
+	"VersionTLS11": tls.VersionTLS11,
+	"VersionTLS12": tls.VersionTLS12,
+	"VersionTLS13": tls.VersionTLS13,
+}
+
+// tlsCipherSuiteNames maps the IANA names of the cipher suites supported by crypto/tls.
+var tlsCipherSuiteNames = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":          tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":        tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// tlsOptions hardens the TLS configuration of the webhook server.
+type tlsOptions struct {
+	minVersion   uint16
+	cipherSuites []uint16
+	// clientCAs verifies the client certificate the API server must present, if set.
+	clientCAs *x509.CertPool
+}
+
+// newTLSOptions parses the TLS flags. An empty cipher suite list keeps the Go defaults, and an
+// empty client CA file disables client certificate verification.
+func newTLSOptions(minVersion string, cipherSuites []string, clientCAFile string) (*tlsOptions, error) {
+	options := &tlsOptions{}
+
+	version, ok := tlsVersionNames[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version %q", minVersion)
+	}
+	options.minVersion = version
+
+	for _, name := range cipherSuites {
+		suite, ok := tlsCipherSuiteNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS cipher suite %q", name)
+		}
+		options.cipherSuites = append(options.cipherSuites, suite)
+	}
+
+	if clientCAFile != "" {
+		data, err := readCertFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		options.clientCAs = x509.NewCertPool()
+		if !options.clientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificate found in %s", clientCAFile)
+		}
+	}
+
+	return options, nil
+}
+
+// configServerTLS configures TLS for the admission webhook server.
+func configServerTLS(certs *certReloader, options *tlsOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     options.minVersion,
+		CipherSuites:   options.cipherSuites,
+	}
+	if options.clientCAs != nil {
+		// Clients without a certificate signed by the client CA are rejected at the handshake.
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = options.clientCAs
+	}
+	return config, nil
 }
 
 func readCertFile(certFile string) ([]byte, error) {
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestCertReloaderWatchesFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8s-metadata-injector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles := func() map[string][]byte {
+		files, err := (&selfSignedIssuer{commonName: "webhook"}).Issue([]string{"webhook"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{serverCertFile, serverKeyFile, caCertFile} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), files[name], 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return files
+	}
+	writeFiles()
+
+	reloader, err := newCertReloader(&certBundle{
+		serverCertFile: filepath.Join(dir, serverCertFile),
+		serverKeyFile:  filepath.Join(dir, serverKeyFile),
+		caCertFile:     filepath.Join(dir, caCertFile),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caChanged := make(chan []byte, 10)
+	reloader.OnCAChange(func(caCert []byte) {
+		caChanged <- caCert
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	// The interval is longer than the test, only the watch can reload the certificate.
+	go reloader.Run(time.Hour, stopCh)
+	// Let the watch start before rotating the files.
+	time.Sleep(100 * time.Millisecond)
+
+	rotated := writeFiles()
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		reloader.mu.RLock()
+		defer reloader.mu.RUnlock()
+		return bytes.Equal(reloader.data.serverCert, rotated[serverCertFile]), nil
+	})
+	if err != nil {
+		t.Fatalf("the rotated certificate was not loaded: %v", err)
+	}
+	// The files are not written atomically, so a partially written CA may be reported first.
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case caCert := <-caChanged:
+			if bytes.Equal(caCert, rotated[caCertFile]) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("the CA change was not reported")
+		}
+	}
+}
@@ -1,13 +1,102 @@
 package main
 
 import (
-	"github.com/ghodss/yaml"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	kindPod                   = "Pod"
+	kindService               = "Service"
+	kindPersistentVolumeClaim = "PersistentVolumeClaim"
+
+	operationCreate = "CREATE"
+	operationUpdate = "UPDATE"
+
+	// conflictPolicyOverride replaces existing values of configured keys.
+	conflictPolicyOverride = "override"
+	// conflictPolicyPreserve keeps existing values of configured keys and only adds missing ones.
+	conflictPolicyPreserve = "preserve"
+
+	// injectionModeOptOut mutates all namespaces except those labeled with injection disabled.
+	injectionModeOptOut = "opt-out"
+	// injectionModeOptIn only mutates namespaces labeled with injection enabled.
+	injectionModeOptIn = "opt-in"
+
+	// namespaceInjectionLabel lets namespace owners enable or disable injection in their namespace.
+	namespaceInjectionLabel = "k8s-metadata-injector.kubernetes.io/injection"
+	injectionEnabled        = "enabled"
+	injectionDisabled       = "disabled"
 )
 
+// supportedResources maps the kinds handled by the k8s-metadata-injector to their resources.
+var supportedResources = []struct {
+	kind     string
+	resource string
+}{
+	{kindPod, "pods"},
+	{kindService, "services"},
+	{kindPersistentVolumeClaim, "persistentvolumeclaims"},
+}
+
+// resourceForKind returns the resource of a supported kind, or an empty string.
+func resourceForKind(kind string) string {
+	for _, r := range supportedResources {
+		if r.kind == kind {
+			return r.resource
+		}
+	}
+	return ""
+}
+
+var defaultOperations = []string{operationCreate, operationUpdate}
+
 type MetadataConfig struct {
 	Namespaces        map[string]NamespaceConfig `json:"namespaces"`
 	IgnoredNamespaces []string                   `json:"ignoredNamespaces"`
+	Operations        OperationsConfig           `json:"operations"`
+	ConflictPolicy    string                     `json:"conflictPolicy"`
+	InjectionMode     string                     `json:"injectionMode"`
+	Registration      RegistrationConfig         `json:"registration"`
+
+	// hash identifies the revision of the configuration.
+	hash string
+}
+
+// RegistrationConfig configures the MutatingWebhookConfiguration registered to the API server.
+type RegistrationConfig struct {
+	FailurePolicy      string                `json:"failurePolicy"`
+	TimeoutSeconds     *int32                `json:"timeoutSeconds"`
+	ReinvocationPolicy string                `json:"reinvocationPolicy"`
+	NamespaceSelector  *metav1.LabelSelector `json:"namespaceSelector"`
+	ObjectSelector     *metav1.LabelSelector `json:"objectSelector"`
+	Tiers              []NamespaceTier       `json:"tiers"`
+}
+
+// NamespaceTier is a group of namespaces registered as a separate webhook entry, e.g. to
+// fail closed for production namespaces. Unset policies fall back to the registration ones.
+// All tiers select their namespaces by the values of the same label, so that the default entry
+// can exclude them and no namespace is sent to two entries.
+type NamespaceTier struct {
+	Name              string                `json:"name"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector"`
+	FailurePolicy     string                `json:"failurePolicy"`
+	TimeoutSeconds    *int32                `json:"timeoutSeconds"`
+}
+
+// OperationsConfig lists the admission operations handled for each kind.
+type OperationsConfig struct {
+	Pod                   []string `json:"pod"`
+	Service               []string `json:"service"`
+	PersistentVolumeClaim []string `json:"persistentVolumeClaim"`
 }
 
 type NamespaceConfig struct {
@@ -32,9 +121,288 @@ func loadConfig(configFile string) (*MetadataConfig, error) {
 		return nil, err
 	}
 
+	// Hash the normalized config so that formatting and comments do not change it.
+	normalized, err := json.Marshal(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(normalized)
+	cfg.hash = hex.EncodeToString(sum[:8])
+
 	return &cfg, nil
 }
 
+// Validate checks that all configured label and annotation keys and values are
+// accepted by the API server, so that injected metadata never breaks admission.
+func (c *MetadataConfig) Validate() error {
+	var errs []string
+	switch c.ConflictPolicy {
+	case "", conflictPolicyOverride, conflictPolicyPreserve:
+	default:
+		errs = append(errs, fmt.Sprintf("conflictPolicy: unsupported value %q", c.ConflictPolicy))
+	}
+	switch c.InjectionMode {
+	case "", injectionModeOptOut, injectionModeOptIn:
+	default:
+		errs = append(errs, fmt.Sprintf("injectionMode: unsupported value %q", c.InjectionMode))
+	}
+	errs = append(errs, c.Registration.validate()...)
+	for _, r := range supportedResources {
+		for _, operation := range c.operationsFor(r.kind) {
+			if operation != operationCreate && operation != operationUpdate {
+				errs = append(errs, fmt.Sprintf("operations.%s: unsupported operation %q", r.kind, operation))
+			}
+		}
+	}
+	for namespace, namespaceConfig := range c.Namespaces {
+		errs = append(errs, namespaceConfig.Pod.validate(namespace+".pod")...)
+		errs = append(errs, namespaceConfig.Service.validate(namespace+".service")...)
+		errs = append(errs, namespaceConfig.PersistentVolumeClaim.validate(namespace+".persistentVolumeClaim")...)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid metadata configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *RegistrationConfig) validate() []string {
+	errs := validatePolicies("registration", r.FailurePolicy, r.TimeoutSeconds)
+	switch r.ReinvocationPolicy {
+	case "", "Never", "IfNeeded":
+	default:
+		errs = append(errs, fmt.Sprintf("registration.reinvocationPolicy: unsupported value %q", r.ReinvocationPolicy))
+	}
+	if _, err := metav1.LabelSelectorAsSelector(r.NamespaceSelector); err != nil {
+		errs = append(errs, fmt.Sprintf("registration.namespaceSelector: %v", err))
+	}
+	if _, err := metav1.LabelSelectorAsSelector(r.ObjectSelector); err != nil {
+		errs = append(errs, fmt.Sprintf("registration.objectSelector: %v", err))
+	}
+
+	names := map[string]bool{}
+	var tierKey string
+	tierValues := map[string]string{}
+	for i, tier := range r.Tiers {
+		path := fmt.Sprintf("registration.tiers[%d]", i)
+		for _, msg := range validation.IsDNS1123Label(tier.Name) {
+			errs = append(errs, fmt.Sprintf("%s.name: %s", path, msg))
+		}
+		if names[tier.Name] {
+			errs = append(errs, fmt.Sprintf("%s.name: duplicate tier %q", path, tier.Name))
+		}
+		names[tier.Name] = true
+		if _, err := metav1.LabelSelectorAsSelector(tier.NamespaceSelector); err != nil {
+			errs = append(errs, fmt.Sprintf("%s.namespaceSelector: %v", path, err))
+		}
+		key, values, ok := tier.selectedLabel()
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s.namespaceSelector: must be a single matchLabels entry or a single In expression", path))
+		} else if tierKey != "" && key != tierKey {
+			errs = append(errs, fmt.Sprintf("%s.namespaceSelector: all tiers must select namespaces by the same label %q", path, tierKey))
+		} else {
+			tierKey = key
+			for _, value := range values {
+				if other, ok := tierValues[value]; ok {
+					errs = append(errs, fmt.Sprintf("%s.namespaceSelector: %s=%s is already selected by tier %q", path, key, value, other))
+				}
+				tierValues[value] = tier.Name
+			}
+		}
+		errs = append(errs, validatePolicies(path, tier.FailurePolicy, tier.TimeoutSeconds)...)
+	}
+	return errs
+}
+
+// selectedLabel returns the label key and values selecting the namespaces of the tier, if its
+// selector is a single matchLabels entry or a single In expression.
+func (t *NamespaceTier) selectedLabel() (string, []string, bool) {
+	selector := t.NamespaceSelector
+	if selector == nil {
+		return "", nil, false
+	}
+	switch {
+	case len(selector.MatchLabels) == 1 && len(selector.MatchExpressions) == 0:
+		for key, value := range selector.MatchLabels {
+			return key, []string{value}, true
+		}
+	case len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 1:
+		requirement := selector.MatchExpressions[0]
+		if requirement.Operator == metav1.LabelSelectorOpIn && len(requirement.Values) > 0 {
+			return requirement.Key, requirement.Values, true
+		}
+	}
+	return "", nil, false
+}
+
+// tierExclusion returns the namespace selector requirement excluding the namespaces of all
+// tiers, or nil if there are none.
+func (r *RegistrationConfig) tierExclusion() *metav1.LabelSelectorRequirement {
+	var requirement *metav1.LabelSelectorRequirement
+	for _, tier := range r.Tiers {
+		key, values, ok := tier.selectedLabel()
+		if !ok {
+			continue
+		}
+		if requirement == nil {
+			requirement = &metav1.LabelSelectorRequirement{Key: key, Operator: metav1.LabelSelectorOpNotIn}
+		}
+		requirement.Values = append(requirement.Values, values...)
+	}
+	return requirement
+}
+
+func validatePolicies(path string, failurePolicy string, timeoutSeconds *int32) []string {
+	var errs []string
+	switch failurePolicy {
+	case "", "Ignore", "Fail":
+	default:
+		errs = append(errs, fmt.Sprintf("%s.failurePolicy: unsupported value %q", path, failurePolicy))
+	}
+	if timeoutSeconds != nil && (*timeoutSeconds < 1 || *timeoutSeconds > 30) {
+		errs = append(errs, fmt.Sprintf("%s.timeoutSeconds: must be between 1 and 30, got %d", path, *timeoutSeconds))
+	}
+	return errs
+}
+
+// ignoredNamespaces returns the configured ignored namespaces along with the default ones.
+func (c *MetadataConfig) ignoredNamespaces() []string {
+	return append(append([]string{}, defaultIgnoredNamespaces...), c.IgnoredNamespaces...)
+}
+
+// operationsFor returns the admission operations handled for the given kind,
+// defaulting to CREATE and UPDATE when none are configured.
+func (c *MetadataConfig) operationsFor(kind string) []string {
+	if c == nil {
+		return defaultOperations
+	}
+	var operations []string
+	switch kind {
+	case kindPod:
+		operations = c.Operations.Pod
+	case kindService:
+		operations = c.Operations.Service
+	case kindPersistentVolumeClaim:
+		operations = c.Operations.PersistentVolumeClaim
+	}
+	if len(operations) == 0 {
+		return defaultOperations
+	}
+	return operations
+}
+
+// handlesOperation reports whether the given operation is configured for the given kind.
+func (c *MetadataConfig) handlesOperation(kind string, operation string) bool {
+	for _, o := range c.operationsFor(kind) {
+		if strings.EqualFold(o, operation) {
+			return true
+		}
+	}
+	return false
+}
+
+// overrideConflicts reports whether configured values replace existing ones.
+func (c *MetadataConfig) overrideConflicts() bool {
+	return c.ConflictPolicy != conflictPolicyPreserve
+}
+
+// namespaceInjectionEnabled reports whether objects in a namespace with the given labels may be
+// mutated. The namespace injection label takes precedence over the injection mode.
+func (c *MetadataConfig) namespaceInjectionEnabled(labels map[string]string) bool {
+	switch labels[namespaceInjectionLabel] {
+	case injectionEnabled:
+		return true
+	case injectionDisabled:
+		return false
+	}
+	return c == nil || c.InjectionMode != injectionModeOptIn
+}
+
+// injectionRequirement returns the namespace selector requirement matching the namespaces
+// where injection is enabled.
+func (c *MetadataConfig) injectionRequirement() metav1.LabelSelectorRequirement {
+	if c != nil && c.InjectionMode == injectionModeOptIn {
+		return metav1.LabelSelectorRequirement{
+			Key:      namespaceInjectionLabel,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   []string{injectionEnabled},
+		}
+	}
+	return metav1.LabelSelectorRequirement{
+		Key:      namespaceInjectionLabel,
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   []string{injectionDisabled},
+	}
+}
+
+// metadataSpecFor returns the effective metadata spec for objects of the given kind
+// in the given namespace, along with the config layer each key comes from. The "*"
+// defaults are merged into the namespace config, namespace values taking precedence.
+// It returns a nil spec if nothing is configured.
+func (c *MetadataConfig) metadataSpecFor(kind string, namespace string) (*MetadataSpec, *metadataSources) {
+	var layers []string
+	if _, ok := c.Namespaces[namespace]; ok {
+		layers = append(layers, namespace)
+	}
+	if _, ok := c.Namespaces["*"]; ok {
+		layers = append(layers, "*")
+	}
+	if len(layers) == 0 {
+		return nil, nil
+	}
+
+	spec := &MetadataSpec{}
+	sources := &metadataSources{
+		Annotations: map[string]string{},
+		Labels:      map[string]string{},
+	}
+	for _, layer := range layers {
+		layerSpec := c.Namespaces[layer].specFor(kind)
+		for k := range layerSpec.Annotations {
+			if _, ok := sources.Annotations[k]; !ok {
+				sources.Annotations[k] = layer
+			}
+		}
+		for k := range layerSpec.Labels {
+			if _, ok := sources.Labels[k]; !ok {
+				sources.Labels[k] = layer
+			}
+		}
+		spec.MergeMetadataSpec(layerSpec)
+	}
+	return spec, sources
+}
+
+// specFor returns the metadata spec configured for the given kind.
+func (n NamespaceConfig) specFor(kind string) MetadataSpec {
+	switch kind {
+	case kindPod:
+		return n.Pod
+	case kindService:
+		return n.Service
+	case kindPersistentVolumeClaim:
+		return n.PersistentVolumeClaim
+	}
+	return MetadataSpec{}
+}
+
+func (m *MetadataSpec) validate(path string) []string {
+	var errs []string
+	for k := range m.Annotations {
+		for _, msg := range validation.IsQualifiedName(k) {
+			errs = append(errs, fmt.Sprintf("%s.annotations[%q]: %s", path, k, msg))
+		}
+	}
+	for k, v := range m.Labels {
+		for _, msg := range validation.IsQualifiedName(k) {
+			errs = append(errs, fmt.Sprintf("%s.labels[%q]: %s", path, k, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(v) {
+			errs = append(errs, fmt.Sprintf("%s.labels[%q]: %s", path, k, msg))
+		}
+	}
+	return errs
+}
+
 func (m *MetadataSpec) MergeMetadataSpec(added MetadataSpec) {
 	for k, v := range added.Annotations {
 		if _, ok := m.Annotations[k]; !ok {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMetadataConfigValidate(t *testing.T) {
+	timeout := func(seconds int32) *int32 { return &seconds }
+
+	tests := []struct {
+		name    string
+		config  MetadataConfig
+		wantErr string
+	}{
+		{
+			name: "valid",
+			config: MetadataConfig{
+				Namespaces: map[string]NamespaceConfig{
+					"*": {Pod: MetadataSpec{
+						Annotations: map[string]string{"example.com/owner": "Team A"},
+						Labels:      map[string]string{"cost-center": "a-1"},
+					}},
+				},
+				ConflictPolicy: conflictPolicyPreserve,
+				InjectionMode:  injectionModeOptIn,
+				Operations:     OperationsConfig{Service: []string{operationCreate}},
+				Registration: RegistrationConfig{
+					FailurePolicy:  "Fail",
+					TimeoutSeconds: timeout(5),
+				},
+			},
+		},
+		{
+			name: "invalid label value",
+			config: MetadataConfig{Namespaces: map[string]NamespaceConfig{
+				"*": {Pod: MetadataSpec{Labels: map[string]string{"owner": "Team A"}}},
+			}},
+			wantErr: `*.pod.labels["owner"]`,
+		},
+		{
+			name: "invalid annotation key",
+			config: MetadataConfig{Namespaces: map[string]NamespaceConfig{
+				"team-a": {Service: MetadataSpec{Annotations: map[string]string{"a/b/c": "x"}}},
+			}},
+			wantErr: `team-a.service.annotations["a/b/c"]`,
+		},
+		{
+			name:    "unsupported conflict policy",
+			config:  MetadataConfig{ConflictPolicy: "merge"},
+			wantErr: "conflictPolicy",
+		},
+		{
+			name:    "unsupported injection mode",
+			config:  MetadataConfig{InjectionMode: "always"},
+			wantErr: "injectionMode",
+		},
+		{
+			name:    "unsupported operation",
+			config:  MetadataConfig{Operations: OperationsConfig{Pod: []string{"DELETE"}}},
+			wantErr: `operations.Pod: unsupported operation "DELETE"`,
+		},
+		{
+			name:    "timeout out of range",
+			config:  MetadataConfig{Registration: RegistrationConfig{TimeoutSeconds: timeout(31)}},
+			wantErr: "registration.timeoutSeconds",
+		},
+		{
+			name:    "unsupported reinvocation policy",
+			config:  MetadataConfig{Registration: RegistrationConfig{ReinvocationPolicy: "Always"}},
+			wantErr: "registration.reinvocationPolicy",
+		},
+		{
+			name: "invalid namespace selector",
+			config: MetadataConfig{Registration: RegistrationConfig{NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Has"}},
+			}}},
+			wantErr: "registration.namespaceSelector",
+		},
+		{
+			name: "tiers selecting the same label",
+			config: MetadataConfig{Registration: RegistrationConfig{Tiers: []NamespaceTier{
+				{Name: "production", NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production"}}},
+				{Name: "staging", NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"staging", "qa"}},
+				}}},
+			}}},
+		},
+		{
+			name: "tier without selector",
+			config: MetadataConfig{Registration: RegistrationConfig{Tiers: []NamespaceTier{
+				{Name: "production"},
+			}}},
+			wantErr: "registration.tiers[0].namespaceSelector",
+		},
+		{
+			name: "tier selecting several labels",
+			config: MetadataConfig{Registration: RegistrationConfig{Tiers: []NamespaceTier{
+				{Name: "production", NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production", "team": "a"}}},
+			}}},
+			wantErr: "registration.tiers[0].namespaceSelector",
+		},
+		{
+			name: "tiers selecting different labels",
+			config: MetadataConfig{Registration: RegistrationConfig{Tiers: []NamespaceTier{
+				{Name: "production", NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production"}}},
+				{Name: "payments", NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}}},
+			}}},
+			wantErr: `all tiers must select namespaces by the same label "env"`,
+		},
+		{
+			name: "overlapping tiers",
+			config: MetadataConfig{Registration: RegistrationConfig{Tiers: []NamespaceTier{
+				{Name: "production", NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production"}}},
+				{Name: "critical", NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"production"}},
+				}}},
+			}}},
+			wantErr: `env=production is already selected by tier "production"`,
+		},
+		{
+			name: "duplicate tier",
+			config: MetadataConfig{Registration: RegistrationConfig{Tiers: []NamespaceTier{
+				{Name: "production", NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production"}}},
+				{Name: "production", NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "staging"}}},
+			}}},
+			wantErr: `duplicate tier "production"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.Validate()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("got error %v, want one about %s", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventReasonConfigInvalid = "ConfigInvalid"
+	eventReasonConfigLoaded  = "ConfigLoaded"
+)
+
+// configStore holds the active metadata configuration and reloads it when its file changes.
+// An invalid configuration never replaces a valid one. Until a valid configuration is loaded,
+// the injector runs in degraded mode: admission requests are allowed without patch, and the
+// readiness check fails.
+type configStore struct {
+	file     string
+	recorder record.EventRecorder
+	ref      *corev1.ObjectReference
+
+	mu       sync.RWMutex
+	config   *MetadataConfig
+	err      error
+	onChange []func(*MetadataConfig)
+}
+
+func newConfigStore(file string, recorder record.EventRecorder, ref *corev1.ObjectReference) *configStore {
+	s := &configStore{
+		file:     file,
+		recorder: recorder,
+		ref:      ref,
+	}
+	s.reload()
+	return s
+}
+
+// Get returns the active configuration, or nil in degraded mode.
+func (s *configStore) Get() *MetadataConfig {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// OnChange registers a function called with the new configuration whenever it changes.
+func (s *configStore) OnChange(fn func(*MetadataConfig)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, fn)
+}
+
+// Run reloads the configuration every interval until stopCh is closed.
+func (s *configStore) Run(interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(s.reload, interval, stopCh)
+}
+
+func (s *configStore) reload() {
+	config, err := loadConfig(s.file)
+	if err == nil {
+		err = config.Validate()
+	}
+
+	s.mu.Lock()
+	current, previousErr := s.config, s.err
+	s.err = err
+	changed := err == nil && (current == nil || current.hash != config.hash)
+	if changed {
+		s.config = config
+	}
+	callbacks := s.onChange
+	s.mu.Unlock()
+
+	configDegraded.Set(boolToFloat(s.Get() == nil))
+
+	if err != nil {
+		// Only report a failure once until the file changes or becomes valid again.
+		if previousErr == nil || previousErr.Error() != err.Error() {
+			recordConfigLoad(err)
+			if current == nil {
+				klog.Errorf("Failed to load configuration, running in degraded mode: %v", err)
+			} else {
+				klog.Errorf("Failed to reload configuration, keeping revision %s: %v", current.hash, err)
+			}
+			s.event(corev1.EventTypeWarning, eventReasonConfigInvalid, "Failed to load configuration: %v", err)
+		}
+		return
+	}
+	if !changed {
+		if previousErr != nil {
+			recordConfigLoad(nil)
+			klog.Infof("Configuration revision %s is valid again", config.hash)
+		}
+		return
+	}
+
+	recordConfigLoad(nil)
+	klog.Infof("Loaded configuration revision %s", config.hash)
+	if current == nil && previousErr != nil {
+		s.event(corev1.EventTypeNormal, eventReasonConfigLoaded, "Loaded configuration revision %s, leaving degraded mode", config.hash)
+	} else if current != nil {
+		s.event(corev1.EventTypeNormal, eventReasonConfigLoaded, "Loaded configuration revision %s", config.hash)
+	}
+	for _, fn := range callbacks {
+		fn(config)
+	}
+}
+
+func (s *configStore) event(eventType string, reason string, messageFmt string, args ...interface{}) {
+	if s.recorder == nil || s.ref == nil {
+		return
+	}
+	s.recorder.Eventf(s.ref, eventType, reason, messageFmt, args...)
+}
+
+// check reports whether a valid configuration is loaded.
+func (s *configStore) check() error {
+	if s.Get() == nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if s.err != nil {
+			return s.err
+		}
+		return errors.New("metadata configuration not loaded")
+	}
+	return nil
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -1,49 +1,73 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/ec2"
+
 	"k8s.io/klog"
 
 	"k8s.io/apimachinery/pkg/fields"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 )
 
 const (
 	ebsTagsAnnotationKey = "ebs-tagger.kubernetes.io/ebs-additional-resource-tags"
+	// ebsManagedTagsAnnotationKey is set on PVs to the comma-separated keys of the tags created
+	// by the tagger on their volume, the only ones it ever deletes.
+	ebsManagedTagsAnnotationKey = "ebs-tagger.kubernetes.io/managed-tags"
+)
+
+const (
+	eventReasonEBSTagged            = "EBSTagged"
+	eventReasonEBSTagFailed         = "EBSTagFailed"
+	eventReasonInvalidTagAnnotation = "InvalidTagAnnotation"
 )
 
 const (
 	resyncPeriod = 30 * time.Minute
 	maxRetries   = 5
+
+	// pvClaimIndex indexes the PVs by the namespace/name key of the claim bound to them.
+	pvClaimIndex = "claim"
 )
 
 type Controller struct {
 	clientset   kubernetes.Interface
+	recorder    record.EventRecorder
 	pvcInformer cache.SharedIndexInformer
 	pvInformer  cache.SharedIndexInformer
 	queue       workqueue.RateLimitingInterface
-}
+	csiDrivers  map[string]bool
+	ebs         *ebsClient
 
-type Task struct {
-	Key    string
-	Action string
+	batchMu sync.Mutex
 }
 
-func NewController(kubeclientset kubernetes.Interface) *Controller {
+func NewController(kubeclientset kubernetes.Interface, recorder record.EventRecorder, ebs *ebsClient, csiDrivers []string) *Controller {
+
+	drivers := make(map[string]bool)
+	for _, driver := range csiDrivers {
+		drivers[driver] = true
+	}
 
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "ebs-tagger")
 
 	listwatchPVC := cache.NewListWatchFromClient(kubeclientset.CoreV1().RESTClient(), "persistentvolumeclaims", metav1.NamespaceAll, fields.Everything())
 	listwatchPV := cache.NewListWatchFromClient(kubeclientset.CoreV1().RESTClient(), "persistentvolumes", metav1.NamespaceAll, fields.Everything())
@@ -59,7 +83,7 @@ func NewController(kubeclientset kubernetes.Interface) *Controller {
 		listwatchPV,
 		&corev1.PersistentVolume{},
 		resyncPeriod,
-		cache.Indexers{},
+		cache.Indexers{pvClaimIndex: indexPVByClaim},
 	)
 
 	pvi.AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -67,13 +91,10 @@ func NewController(kubeclientset kubernetes.Interface) *Controller {
 			key, err := cache.MetaNamespaceKeyFunc(obj)
 			if err == nil {
 				pv := obj.(*corev1.PersistentVolume)
-				if pv.Spec.PersistentVolumeSource.AWSElasticBlockStore == nil {
+				if _, ok := ebsVolumeSource(pv, drivers); !ok {
 					return
 				}
-				queue.AddRateLimited(Task{
-					Key:    key,
-					Action: "CREATE",
-				})
+				queue.Add(key)
 			} else {
 				runtime.HandleError(err)
 				return
@@ -87,13 +108,10 @@ func NewController(kubeclientset kubernetes.Interface) *Controller {
 				if pvNew.ResourceVersion == pvOld.ResourceVersion {
 					return
 				}
-				if pvNew.Spec.PersistentVolumeSource.AWSElasticBlockStore == nil {
+				if _, ok := ebsVolumeSource(pvNew, drivers); !ok {
 					return
 				}
-				queue.AddRateLimited(Task{
-					Key:    key,
-					Action: "UPDATE",
-				})
+				queue.Add(key)
 			} else {
 				runtime.HandleError(err)
 				return
@@ -101,12 +119,86 @@ func NewController(kubeclientset kubernetes.Interface) *Controller {
 		},
 	})
 
-	return &Controller{
+	c := &Controller{
 		clientset:   kubeclientset,
+		recorder:    recorder,
 		pvcInformer: pvci,
 		pvInformer:  pvi,
 		queue:       queue,
+		csiDrivers:  drivers,
+		ebs:         ebs,
 	}
+
+	// The volume of a bound claim is tagged again when the tags annotation of the claim changes.
+	pvci.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pvc := obj.(*corev1.PersistentVolumeClaim)
+			if _, ok := pvc.Annotations[ebsTagsAnnotationKey]; !ok {
+				return
+			}
+			c.enqueueClaimVolumes(pvc)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			pvcNew := new.(*corev1.PersistentVolumeClaim)
+			pvcOld := old.(*corev1.PersistentVolumeClaim)
+			if pvcNew.ResourceVersion == pvcOld.ResourceVersion {
+				return
+			}
+			if pvcNew.Annotations[ebsTagsAnnotationKey] == pvcOld.Annotations[ebsTagsAnnotationKey] &&
+				pvcNew.Spec.VolumeName == pvcOld.Spec.VolumeName {
+				return
+			}
+			c.enqueueClaimVolumes(pvcNew)
+		},
+	})
+
+	return c
+}
+
+// enqueueClaimVolumes enqueues the EBS volumes bound to a claim: the volume set in its
+// Spec.VolumeName, and the volumes whose claimRef already points to it.
+func (c *Controller) enqueueClaimVolumes(pvc *corev1.PersistentVolumeClaim) {
+	key, err := cache.MetaNamespaceKeyFunc(pvc)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	volumes := make(map[string]bool)
+	if pvc.Spec.VolumeName != "" {
+		volumes[pvc.Spec.VolumeName] = true
+	}
+	objs, err := c.pvInformer.GetIndexer().ByIndex(pvClaimIndex, key)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, obj := range objs {
+		volumes[obj.(*corev1.PersistentVolume).Name] = true
+	}
+
+	for name := range volumes {
+		obj, exists, err := c.pvInformer.GetIndexer().GetByKey(name)
+		if err != nil {
+			runtime.HandleError(err)
+			continue
+		}
+		if !exists {
+			continue
+		}
+		if _, ok := ebsVolumeSource(obj.(*corev1.PersistentVolume), c.csiDrivers); !ok {
+			continue
+		}
+		c.queue.Add(name)
+	}
+}
+
+// indexPVByClaim returns the namespace/name key of the claim bound to a PV.
+func indexPVByClaim(obj interface{}) ([]string, error) {
+	pv, ok := obj.(*corev1.PersistentVolume)
+	if !ok || pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Kind != "PersistentVolumeClaim" {
+		return nil, nil
+	}
+	return []string{pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name}, nil
 }
 
 func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) {
@@ -142,99 +234,375 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) {
 	<-stopCh
 }
 
+// HasSynced returns true once the PVC and PV informer caches have synced.
+func (c *Controller) HasSynced() bool {
+	return c.pvcInformer.HasSynced() && c.pvInformer.HasSynced()
+}
+
+// checkCacheSync reports whether the informer caches of the controller have synced.
+func (c *Controller) checkCacheSync() error {
+	if !c.HasSynced() {
+		return fmt.Errorf("ebs-tagger informer caches not synced")
+	}
+	return nil
+}
+
 // runWorker is a long-running function that will continually call the
-// processNextWorkItem function in order to read and process a message on the
+// processNextBatch function in order to read and process messages on the
 // workqueue.
 func (c *Controller) runWorker() {
-	for c.processNext() {
+	for c.processNextBatch() {
 	}
 }
 
-// processNext will read a single work item off the workqueue and
-// attempt to process it, by calling the process.
-func (c *Controller) processNext() bool {
-	key, quit := c.queue.Get()
+// processNextBatch will read the pending work items off the workqueue, up to
+// ebsBatchSize, and attempt to process them together, so that volumes sharing
+// the same tags are tagged with a single EC2 request.
+func (c *Controller) processNextBatch() bool {
+	keys, quit := c.nextBatch()
 
 	if quit {
 		return false
 	}
+
+	errs := c.processBatch(keys)
+	for _, key := range keys {
+		c.handleResult(key, errs[key])
+	}
+
+	return true
+}
+
+// nextBatch waits for a work item, then reads the other pending ones. Work items are PV names.
+func (c *Controller) nextBatch() ([]string, bool) {
+	// Only one worker reads a batch at a time, so that the queue cannot be emptied by another
+	// worker between Len and Get.
+	c.batchMu.Lock()
+	defer c.batchMu.Unlock()
+
+	key, quit := c.queue.Get()
+	if quit {
+		return nil, true
+	}
+	keys := []string{key.(string)}
+	for len(keys) < ebsBatchSize && c.queue.Len() > 0 {
+		key, quit := c.queue.Get()
+		if quit {
+			break
+		}
+		keys = append(keys, key.(string))
+	}
+	return keys, false
+}
+
+func (c *Controller) handleResult(key string, err error) {
 	defer c.queue.Done(key)
 
-	err := c.process(key.(Task))
 	if err == nil {
 		// No error, reset the ratelimit counters
 		c.queue.Forget(key)
 	} else if c.queue.NumRequeues(key) < maxRetries {
 		klog.Infof("Error processing %s (will retry): %v", key, err)
+		ebsTagRetriesTotal.Inc()
 		c.queue.AddRateLimited(key)
 	} else {
 		// err != nil and too many retries
 		klog.Errorf("Error processing %s (giving up): %v", key, err)
+		ebsTagDroppedTotal.Inc()
 		c.queue.Forget(key)
 		runtime.HandleError(err)
 	}
+}
 
-	return true
+// tagPlan is the tag synchronization of the volume of a PV.
+type tagPlan struct {
+	pv       *corev1.PersistentVolume
+	pvc      *corev1.PersistentVolumeClaim
+	volumeID string
+	desired  []*ec2.Tag
+	managed  []string
+
+	create []*ec2.Tag
+	remove []string
+	owned  []string
+	err    error
 }
 
-func (c *Controller) process(task Task) error {
+// processBatch synchronizes the tags of the volumes of a batch and returns the errors by PV name.
+func (c *Controller) processBatch(keys []string) map[string]error {
+	errs := make(map[string]error)
+	var plans []*tagPlan
+	for _, key := range keys {
+		plan, err := c.plan(key)
+		errs[key] = err
+		if plan != nil {
+			plans = append(plans, plan)
+		}
+	}
+	if len(plans) == 0 {
+		return errs
+	}
 
-	obj, exists, err := c.pvInformer.GetIndexer().GetByKey(task.Key)
+	c.syncTags(plans)
+
+	for _, plan := range plans {
+		key := plan.pv.Name
+		pvcName := plan.pvc.Namespace + "/" + plan.pvc.Name
+		if plan.err != nil {
+			errs[key] = plan.err
+			c.recorder.Eventf(plan.pvc, corev1.EventTypeWarning, eventReasonEBSTagFailed, "Failed to tag EBS volume %s: %v", plan.volumeID, plan.err)
+			c.recorder.Eventf(plan.pv, corev1.EventTypeWarning, eventReasonEBSTagFailed, "Failed to tag EBS volume %s: %v", plan.volumeID, plan.err)
+			continue
+		}
+		if len(plan.create) == 0 && len(plan.remove) == 0 {
+			continue
+		}
+		klog.Infof("Tags synchronized for EBS %q (%q): set [%s], removed %v", plan.volumeID, pvcName, formatEBSTags(plan.create), plan.remove)
+		message := fmt.Sprintf("Tagged EBS volume %s with %s", plan.volumeID, formatEBSTags(plan.create))
+		if len(plan.create) == 0 {
+			message = fmt.Sprintf("Removed tags %s from EBS volume %s", strings.Join(plan.remove, ","), plan.volumeID)
+		} else if len(plan.remove) > 0 {
+			message += fmt.Sprintf(", removed tags %s", strings.Join(plan.remove, ","))
+		}
+		c.recorder.Event(plan.pvc, corev1.EventTypeNormal, eventReasonEBSTagged, message)
+		c.recorder.Event(plan.pv, corev1.EventTypeNormal, eventReasonEBSTagged, message)
+	}
+	return errs
+}
+
+// plan returns the tag synchronization of the volume of a PV, or nil if there is nothing to do.
+func (c *Controller) plan(key string) (*tagPlan, error) {
+
+	obj, exists, err := c.pvInformer.GetIndexer().GetByKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve pv by key %q: %v", key, err)
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	pv := obj.(*corev1.PersistentVolume)
+
+	volume, ok := ebsVolumeSource(pv, c.csiDrivers)
+	if !ok || volume == "" {
+		return nil, nil
+	}
+
+	var volumeID string
+	volumeIDList := strings.Split(volume, "/")
+
+	if len(volumeIDList) == 4 {
+		volumeID = volumeIDList[3]
+	} else if len(volumeIDList) == 1 {
+		volumeID = volumeIDList[0]
+	} else {
+		return nil, fmt.Errorf("failed to parse EBS %q", volume)
+	}
+
+	if pv.Spec.ClaimRef == nil {
+		return nil, nil
+	}
+
+	if pv.Spec.ClaimRef.Kind != "PersistentVolumeClaim" {
+		return nil, nil
+	}
+
+	pvcName := pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+
+	objPVC, existsPVC, err := c.pvcInformer.GetIndexer().GetByKey(pvcName)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve pv by key %q: %v", task.Key, err)
+		return nil, fmt.Errorf("failed to retrieve pvc by key %q: %v", pvcName, err)
 	}
 
-	if exists {
+	if !existsPVC {
+		return nil, nil
+	}
 
-		pv := obj.(*corev1.PersistentVolume)
+	pvc := objPVC.(*corev1.PersistentVolumeClaim)
 
-		volume := pv.Spec.PersistentVolumeSource.AWSElasticBlockStore.VolumeID
-		if volume == "" {
-			return nil
+	annotation, annotated := pvc.Annotations[ebsTagsAnnotationKey]
+	managed := managedEBSTagKeys(pv)
+	if !annotated && len(managed) == 0 {
+		return nil, nil
+	}
+
+	var tags []*ec2.Tag
+	if annotated {
+		tags, err = getEBSTags(annotation)
+		if err != nil {
+			// Retrying does not help until the annotation is fixed.
+			klog.Warningf("Invalid annotation %s of %q: %v", ebsTagsAnnotationKey, pvcName, err)
+			c.recorder.Eventf(pvc, corev1.EventTypeWarning, eventReasonInvalidTagAnnotation, "Invalid %s annotation: %v", ebsTagsAnnotationKey, err)
+			return nil, nil
 		}
+	}
+
+	return &tagPlan{
+		pv:       pv,
+		pvc:      pvc,
+		volumeID: volumeID,
+		desired:  tags,
+		managed:  managed,
+	}, nil
+}
 
-		var volumeID string
-		volumeIDList := strings.Split(volume, "/")
+// ebsVolumeSource returns the EBS volume of a PV, and whether it is an EBS volume at all: either
+// an in-tree awsElasticBlockStore volume, as aws://<zone>/<volume-id> or <volume-id>, or a CSI
+// volume of one of the EBS CSI drivers, whose volumeHandle is the volume ID.
+func ebsVolumeSource(pv *corev1.PersistentVolume, csiDrivers map[string]bool) (string, bool) {
+	if ebs := pv.Spec.PersistentVolumeSource.AWSElasticBlockStore; ebs != nil {
+		return ebs.VolumeID, true
+	}
+	if csi := pv.Spec.PersistentVolumeSource.CSI; csi != nil && csiDrivers[csi.Driver] {
+		return csi.VolumeHandle, true
+	}
+	return "", false
+}
 
-		if len(volumeIDList) == 4 {
-			volumeID = volumeIDList[3]
-		} else if len(volumeIDList) == 1 {
-			volumeID = volumeIDList[0]
-		} else {
-			return fmt.Errorf("failed to parse EBS %q", volume)
+// syncTags sets the desired tags on the volumes of the plans, and deletes the managed tags no
+// longer desired. The current tags are read with a single request, and the volumes sharing the
+// same tags to create or delete are updated together.
+func (c *Controller) syncTags(plans []*tagPlan) {
+	volumes := make([]string, 0, len(plans))
+	for _, plan := range plans {
+		volumes = append(volumes, plan.volumeID)
+	}
+	current, err := c.ebs.describeTags(volumes)
+	if err != nil {
+		for _, plan := range plans {
+			plan.err = err
 		}
+		return
+	}
 
-		if pv.Spec.ClaimRef == nil {
-			return nil
+	for _, plan := range plans {
+		plan.create, plan.remove, plan.owned = diffEBSTags(current[plan.volumeID], plan.desired, plan.managed)
+		if len(plan.create) == 0 && len(plan.remove) == 0 {
+			continue
+		}
+		// The created keys are recorded first, so that they are deleted later even if the
+		// tagger stops before recording the final keys.
+		recorded := unionStrings(plan.managed, plan.owned)
+		if !equalStrings(recorded, plan.managed) {
+			if plan.err = c.setManagedEBSTagKeys(plan.pv, recorded); plan.err == nil {
+				plan.managed = recorded
+			}
 		}
+	}
 
-		if pv.Spec.ClaimRef.Kind != "PersistentVolumeClaim" {
-			return nil
+	creates := make(map[string][]*tagPlan)
+	for _, plan := range plans {
+		if plan.err == nil && len(plan.create) > 0 {
+			key := formatEBSTags(plan.create)
+			creates[key] = append(creates[key], plan)
 		}
+	}
+	for _, group := range creates {
+		tags := group[0].create
+		c.batchRequest(group, func(volumes []string) error {
+			return c.ebs.createTags(volumes, tags)
+		})
+	}
 
-		pvcName := pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+	deletes := make(map[string][]*tagPlan)
+	for _, plan := range plans {
+		if plan.err == nil && len(plan.remove) > 0 {
+			key := strings.Join(plan.remove, ",")
+			deletes[key] = append(deletes[key], plan)
+		}
+	}
+	for _, group := range deletes {
+		keys := group[0].remove
+		c.batchRequest(group, func(volumes []string) error {
+			return c.ebs.deleteTags(volumes, keys)
+		})
+	}
 
-		objPVC, existsPVC, err := c.pvcInformer.GetIndexer().GetByKey(pvcName)
-		if err != nil {
-			return fmt.Errorf("failed to retrieve pvc by key %q: %v", task.Key, err)
+	for _, plan := range plans {
+		if plan.err == nil && !equalStrings(plan.owned, plan.managed) {
+			plan.err = c.setManagedEBSTagKeys(plan.pv, plan.owned)
 		}
+	}
+}
 
-		if existsPVC {
-			pvc := objPVC.(*corev1.PersistentVolumeClaim)
+// batchRequest runs an EC2 request for the volumes of a group of plans. If it fails, it is run
+// again for each volume, so that a single failing volume, e.g. deleted in the meantime, does
+// not fail the others.
+func (c *Controller) batchRequest(group []*tagPlan, request func(volumes []string) error) {
+	volumes := make([]string, 0, len(group))
+	for _, plan := range group {
+		volumes = append(volumes, plan.volumeID)
+	}
+	err := request(volumes)
+	if err == nil || len(group) == 1 {
+		for _, plan := range group {
+			plan.err = err
+		}
+		return
+	}
+	for _, plan := range group {
+		plan.err = request([]string{plan.volumeID})
+	}
+}
 
-			if annotation, ok := pvc.Annotations[ebsTagsAnnotationKey]; ok {
-				tags := getEBSTags(annotation)
-				if tags != nil {
-					err = createTags(&volumeID, tags)
-					if err != nil {
-						return err
-					}
-					klog.Infof("Tags created for EBS %q (%q)!", volumeID, pvcName)
-				}
-			}
+// managedEBSTagKeys returns the keys of the tags created by the tagger on the volume of a PV.
+func managedEBSTagKeys(pv *corev1.PersistentVolume) []string {
+	var keys []string
+	for _, key := range strings.Split(pv.Annotations[ebsManagedTagsAnnotationKey], ",") {
+		if key != "" {
+			keys = append(keys, key)
 		}
 	}
+	sort.Strings(keys)
+	return keys
+}
 
+// setManagedEBSTagKeys records the keys of the tags created by the tagger on the volume of a PV.
+func (c *Controller) setManagedEBSTagKeys(pv *corev1.PersistentVolume, keys []string) error {
+	var value interface{}
+	if len(keys) > 0 {
+		value = strings.Join(keys, ",")
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				ebsManagedTagsAnnotationKey: value,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.clientset.CoreV1().PersistentVolumes().Patch(pv.Name, types.MergePatchType, patch)
+	if err != nil {
+		return fmt.Errorf("failed to record the managed tags of pv %q: %v", pv.Name, err)
+	}
 	return nil
+}
 
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// unionStrings returns the sorted union of two lists.
+func unionStrings(a, b []string) []string {
+	set := make(map[string]bool)
+	for _, item := range append(append([]string{}, a...), b...) {
+		set[item] = true
+	}
+	union := make([]string, 0, len(set))
+	for item := range set {
+		union = append(union, item)
+	}
+	sort.Strings(union)
+	return union
 }
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// countingEC2 is an in-memory EC2 API holding the tags of volumes and counting the requests.
+// Like EC2, a CreateTags or DeleteTags request fails as a whole if one of its volumes is
+// missing.
+type countingEC2 struct {
+	ec2iface.EC2API
+	tags    map[string]map[string]string
+	calls   map[string]int
+	missing map[string]bool
+}
+
+func newCountingEC2() *countingEC2 {
+	return &countingEC2{
+		tags:    map[string]map[string]string{},
+		calls:   map[string]int{},
+		missing: map[string]bool{},
+	}
+}
+
+// total returns the number of requests of all operations.
+func (f *countingEC2) total() int {
+	total := 0
+	for _, calls := range f.calls {
+		total += calls
+	}
+	return total
+}
+
+func (f *countingEC2) checkVolumes(volumes []*string) error {
+	for _, volume := range aws.StringValueSlice(volumes) {
+		if f.missing[volume] {
+			return awserr.New("InvalidVolume.NotFound", fmt.Sprintf("The volume '%s' does not exist.", volume), nil)
+		}
+	}
+	return nil
+}
+
+func (f *countingEC2) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	f.calls[ec2OperationCreateTags]++
+	if err := f.checkVolumes(input.Resources); err != nil {
+		return nil, err
+	}
+	for _, volume := range aws.StringValueSlice(input.Resources) {
+		if f.tags[volume] == nil {
+			f.tags[volume] = map[string]string{}
+		}
+		for _, tag := range input.Tags {
+			f.tags[volume][aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *countingEC2) DeleteTags(input *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	f.calls[ec2OperationDeleteTags]++
+	if err := f.checkVolumes(input.Resources); err != nil {
+		return nil, err
+	}
+	for _, volume := range aws.StringValueSlice(input.Resources) {
+		for _, tag := range input.Tags {
+			delete(f.tags[volume], aws.StringValue(tag.Key))
+		}
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+func (f *countingEC2) DescribeTagsPages(input *ec2.DescribeTagsInput, fn func(*ec2.DescribeTagsOutput, bool) bool) error {
+	f.calls[ec2OperationDescribeTags]++
+	output := &ec2.DescribeTagsOutput{}
+	for _, filter := range input.Filters {
+		for _, volume := range aws.StringValueSlice(filter.Values) {
+			for key, value := range f.tags[volume] {
+				output.Tags = append(output.Tags, &ec2.TagDescription{
+					ResourceId: aws.String(volume),
+					Key:        aws.String(key),
+					Value:      aws.String(value),
+				})
+			}
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+// newTaggingController returns a controller tagging volumes through api, with the given number
+// of PVs, and the plans tagging each of them with one of tagSets.
+func newTaggingController(api *countingEC2, volumes int, tagSets []string) (*Controller, []*tagPlan, error) {
+	var desired [][]*ec2.Tag
+	for _, tagSet := range tagSets {
+		tags, err := getEBSTags(tagSet)
+		if err != nil {
+			return nil, nil, err
+		}
+		desired = append(desired, tags)
+	}
+	var objects []runtime.Object
+	var plans []*tagPlan
+	for i := 0; i < volumes; i++ {
+		pv := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pv-%d", i)}}
+		objects = append(objects, pv)
+		plans = append(plans, &tagPlan{
+			pv:       pv,
+			volumeID: fmt.Sprintf("vol-%d", i),
+			desired:  desired[i%len(desired)],
+		})
+	}
+	c := &Controller{
+		clientset: fake.NewSimpleClientset(objects...),
+		ebs:       &ebsClient{ec2: api},
+	}
+	return c, plans, nil
+}
+
+// syncBatches synchronizes the tags of the plans batch by batch, as the workers do.
+func syncBatches(c *Controller, plans []*tagPlan) error {
+	for start := 0; start < len(plans); start += ebsBatchSize {
+		end := start + ebsBatchSize
+		if end > len(plans) {
+			end = len(plans)
+		}
+		c.syncTags(plans[start:end])
+	}
+	for _, plan := range plans {
+		if plan.err != nil {
+			return fmt.Errorf("failed to tag %s: %v", plan.volumeID, plan.err)
+		}
+	}
+	return nil
+}
+
+// resetPlans clears the results of the plans, recording the managed keys as the controller
+// would read them from the PVs.
+func resetPlans(plans []*tagPlan) {
+	for _, plan := range plans {
+		plan.managed = plan.owned
+		plan.create, plan.remove, plan.owned, plan.err = nil, nil, nil, nil
+	}
+}
+
+var benchmarkTagSets = []string{
+	"team=storage,env=production",
+	"team=storage,env=staging",
+	"team=data,env=production",
+	"team=data,env=staging",
+	"team=web",
+}
+
+// BenchmarkSyncTags compares tagging volumes one by one with a CreateTags request each, as the
+// tagger did before batching, with tagging them batch by batch, and measures the resync of
+// volumes already tagged. The EC2 requests per run are reported as the ec2-calls/op metric.
+func BenchmarkSyncTags(b *testing.B) {
+	const volumes = 1000
+
+	b.Run("unbatched", func(b *testing.B) {
+		api := newCountingEC2()
+		c, plans, err := newTaggingController(api, volumes, benchmarkTagSets)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			for _, plan := range plans {
+				if err := c.ebs.createTags([]string{plan.volumeID}, plan.desired); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(api.total())/float64(b.N), "ec2-calls/op")
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		api := newCountingEC2()
+		c, plans, err := newTaggingController(api, volumes, benchmarkTagSets)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			api.tags = map[string]map[string]string{}
+			resetPlans(plans)
+			for _, plan := range plans {
+				plan.managed = nil
+			}
+			b.StartTimer()
+
+			if err := syncBatches(c, plans); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+
+		batches := (volumes + ebsBatchSize - 1) / ebsBatchSize
+		if calls := api.calls[ec2OperationDescribeTags]; calls != batches*b.N {
+			b.Errorf("%s called %d times for %d runs, want %d", ec2OperationDescribeTags, calls, b.N, batches*b.N)
+		}
+		if calls := api.calls[ec2OperationCreateTags]; calls != batches*len(benchmarkTagSets)*b.N {
+			b.Errorf("%s called %d times for %d runs, want %d", ec2OperationCreateTags, calls, b.N, batches*len(benchmarkTagSets)*b.N)
+		}
+		b.ReportMetric(float64(api.total())/float64(b.N), "ec2-calls/op")
+	})
+
+	b.Run("already tagged", func(b *testing.B) {
+		api := newCountingEC2()
+		c, plans, err := newTaggingController(api, volumes, benchmarkTagSets)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := syncBatches(c, plans); err != nil {
+			b.Fatal(err)
+		}
+		api.calls = map[string]int{}
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			resetPlans(plans)
+			b.StartTimer()
+
+			if err := syncBatches(c, plans); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+
+		batches := (volumes + ebsBatchSize - 1) / ebsBatchSize
+		if calls := api.calls[ec2OperationDescribeTags]; calls != batches*b.N || api.total() != calls {
+			b.Errorf("got calls %v for %d runs, want only %d %s", api.calls, b.N, batches*b.N, ec2OperationDescribeTags)
+		}
+		b.ReportMetric(float64(api.total())/float64(b.N), "ec2-calls/op")
+	})
+}
+
+// TestSyncTagsRequests checks the number of EC2 requests given in the README for 5000 PVs
+// sharing 5 tag sets.
+func TestSyncTagsRequests(t *testing.T) {
+	api := newCountingEC2()
+	c, plans, err := newTaggingController(api, 5000, benchmarkTagSets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syncBatches(c, plans); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{ec2OperationDescribeTags: 50, ec2OperationCreateTags: 250}
+	if !reflect.DeepEqual(api.calls, want) {
+		t.Errorf("initial synchronization: calls %v, want %v", api.calls, want)
+	}
+
+	api.calls = map[string]int{}
+	resetPlans(plans)
+	if err := syncBatches(c, plans); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]int{ec2OperationDescribeTags: 50}
+	if !reflect.DeepEqual(api.calls, want) {
+		t.Errorf("resync: calls %v, want %v", api.calls, want)
+	}
+}
+
+// TestSyncTagsFallsBackToEachVolume checks that a failed grouped request is run again for each
+// volume, so that only the missing volume fails.
+func TestSyncTagsFallsBackToEachVolume(t *testing.T) {
+	api := newCountingEC2()
+	c, plans, err := newTaggingController(api, 4, []string{"team=storage"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.missing["vol-2"] = true
+
+	c.syncTags(plans)
+	want := map[string]int{ec2OperationDescribeTags: 1, ec2OperationCreateTags: 1 + len(plans)}
+	if !reflect.DeepEqual(api.calls, want) {
+		t.Errorf("create: calls %v, want %v", api.calls, want)
+	}
+	for _, plan := range plans {
+		if failed := plan.err != nil; failed != (plan.volumeID == "vol-2") {
+			t.Errorf("create: %s error %v", plan.volumeID, plan.err)
+		}
+	}
+
+	// Dropping the tag deletes it from the volumes that were tagged, with the same fallback.
+	api.calls = map[string]int{}
+	api.tags["vol-2"] = map[string]string{"team": "storage"}
+	resetPlans(plans)
+	for _, plan := range plans {
+		plan.desired = nil
+		plan.managed = []string{"team"}
+	}
+	c.syncTags(plans)
+	want = map[string]int{ec2OperationDescribeTags: 1, ec2OperationDeleteTags: 1 + len(plans)}
+	if !reflect.DeepEqual(api.calls, want) {
+		t.Errorf("delete: calls %v, want %v", api.calls, want)
+	}
+	for _, plan := range plans {
+		if failed := plan.err != nil; failed != (plan.volumeID == "vol-2") {
+			t.Errorf("delete: %s error %v", plan.volumeID, plan.err)
+		}
+		if plan.volumeID != "vol-2" && len(api.tags[plan.volumeID]) != 0 {
+			t.Errorf("delete: %s still has tags %v", plan.volumeID, api.tags[plan.volumeID])
+		}
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	c := &Controller{queue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())}
+	for i := 0; i < ebsBatchSize+10; i++ {
+		c.queue.Add(fmt.Sprintf("pv-%d", i))
+	}
+
+	for _, want := range []int{ebsBatchSize, 10} {
+		keys, quit := c.nextBatch()
+		if quit || len(keys) != want {
+			t.Fatalf("got %d keys (quit %v), want %d", len(keys), quit, want)
+		}
+		for _, key := range keys {
+			c.queue.Done(key)
+		}
+	}
+
+	// A key added again while being processed is only read once it is done.
+	c.queue.Add("pv-0")
+	keys, _ := c.nextBatch()
+	c.queue.Add("pv-0")
+	if c.queue.Len() != 0 {
+		t.Errorf("a key being processed was queued again")
+	}
+	c.queue.Done(keys[0])
+	if keys, _ := c.nextBatch(); !reflect.DeepEqual(keys, []string{"pv-0"}) {
+		t.Errorf("got keys %v, want [pv-0]", keys)
+	}
+
+	c.queue.ShutDown()
+	if _, quit := c.nextBatch(); !quit {
+		t.Error("nextBatch() did not quit after the queue was shut down")
+	}
+}
+
+func TestGetEBSTags(t *testing.T) {
+	tests := []struct {
+		annotation string
+		want       string
+		wantErr    bool
+	}{
+		{annotation: "", want: ""},
+		{annotation: "  ", want: ""},
+		{annotation: "team=storage, env=prod", want: "team=storage,env=prod"},
+		{annotation: "backup", want: "backup="},
+		{annotation: "team=", want: "team="},
+		{annotation: "team=devops=prod", wantErr: true},
+		{annotation: "=prod", wantErr: true},
+		{annotation: "team=a,team=b", wantErr: true},
+	}
+	for _, test := range tests {
+		tags, err := getEBSTags(test.annotation)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("getEBSTags(%q) = %s, want an error", test.annotation, formatEBSTags(tags))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("getEBSTags(%q): %v", test.annotation, err)
+			continue
+		}
+		if got := formatEBSTags(tags); got != test.want {
+			t.Errorf("getEBSTags(%q) = %s, want %s", test.annotation, got, test.want)
+		}
+	}
+}
+
+func TestDiffEBSTags(t *testing.T) {
+	tests := []struct {
+		name       string
+		current    map[string]string
+		desired    string
+		managed    []string
+		wantCreate string
+		wantRemove []string
+		wantOwned  []string
+	}{
+		{
+			name:       "untagged volume",
+			desired:    "team=storage,env=prod",
+			wantCreate: "env=prod,team=storage",
+			wantOwned:  []string{"env", "team"},
+		},
+		{
+			name:      "already tagged",
+			current:   map[string]string{"team": "storage"},
+			desired:   "team=storage",
+			managed:   []string{"team"},
+			wantOwned: []string{"team"},
+		},
+		{
+			name:       "managed value changed",
+			current:    map[string]string{"team": "storage"},
+			desired:    "team=data",
+			managed:    []string{"team"},
+			wantCreate: "team=data",
+			wantOwned:  []string{"team"},
+		},
+		{
+			name:       "existing tag is not owned",
+			current:    map[string]string{"team": "storage"},
+			desired:    "team=data",
+			wantCreate: "team=data",
+		},
+		{
+			name:       "managed key dropped",
+			current:    map[string]string{"team": "storage", "env": "prod"},
+			desired:    "team=storage",
+			managed:    []string{"env", "team"},
+			wantRemove: []string{"env"},
+			wantOwned:  []string{"team"},
+		},
+		{
+			name:      "unmanaged key dropped",
+			current:   map[string]string{"team": "storage", "env": "prod"},
+			desired:   "team=storage",
+			managed:   []string{"team"},
+			wantOwned: []string{"team"},
+		},
+		{
+			name:    "managed key already deleted",
+			desired: "",
+			managed: []string{"env"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			desired, err := getEBSTags(test.desired)
+			if err != nil {
+				t.Fatal(err)
+			}
+			create, remove, owned := diffEBSTags(test.current, desired, test.managed)
+			if got := formatEBSTags(create); got != test.wantCreate {
+				t.Errorf("create %s, want %s", got, test.wantCreate)
+			}
+			if !reflect.DeepEqual(remove, test.wantRemove) {
+				t.Errorf("remove %v, want %v", remove, test.wantRemove)
+			}
+			if !reflect.DeepEqual(owned, test.wantOwned) {
+				t.Errorf("owned %v, want %v", owned, test.wantOwned)
+			}
+		})
+	}
+}
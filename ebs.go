@@ -2,67 +2,198 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
-
-	"k8s.io/klog"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
-func getEBSTags(annotation string) []*ec2.Tag {
+// getEBSTags parses the tags of the ebs-additional-resource-tags annotation, a comma-separated
+// list of key=value or key items. An empty annotation sets no tags.
+func getEBSTags(annotation string) ([]*ec2.Tag, error) {
 
 	var tags []*ec2.Tag
+	seen := make(map[string]bool)
 
+	if strings.TrimSpace(annotation) == "" {
+		return nil, nil
+	}
 	tagsList := strings.Split(strings.TrimSpace(annotation), ",")
 
 	for _, v := range tagsList {
 
 		tag := strings.Split(strings.TrimSpace(v), "=")
 
+		if len(tag) > 2 {
+			return nil, fmt.Errorf("invalid tag %q", v)
+		}
+		if tag[0] == "" {
+			return nil, fmt.Errorf("empty key in tag %q", v)
+		}
+		if seen[tag[0]] {
+			return nil, fmt.Errorf("duplicate key %q", tag[0])
+		}
+		seen[tag[0]] = true
+
+		value := ""
 		if len(tag) == 2 {
-			tags = append(tags, &ec2.Tag{
-				Key:   aws.String(tag[0]),
-				Value: aws.String(tag[1]),
-			})
-		} else if len(tag) == 1 {
-			tags = append(tags, &ec2.Tag{
-				Key:   aws.String(tag[0]),
-				Value: aws.String(""),
-			})
-		} else {
-			klog.Warningf("Invalid annotation %q:", annotation)
-			return nil
+			value = tag[1]
 		}
+		tags = append(tags, &ec2.Tag{
+			Key:   aws.String(tag[0]),
+			Value: aws.String(value),
+		})
 	}
 
-	return tags
+	return tags, nil
 
 }
 
-func createTags(volume *string, tags []*ec2.Tag) error {
+// ebsBatchSize is the maximum number of volumes tagged together, below the 200 values EC2
+// accepts per filter.
+const ebsBatchSize = 100
 
-	sess := session.New(&aws.Config{Region: aws.String(getRegion())})
-	ec2Client := ec2.New(sess)
+// ebsClient tags EBS volumes through an EC2 client created once, so that the session and the
+// region lookup are not repeated for every volume.
+type ebsClient struct {
+	ec2 ec2iface.EC2API
+}
+
+// newEBSClient returns an EBS client from the AWS options, and logs the AWS identity in use.
+func newEBSClient(options awsOptions) (*ebsClient, error) {
+	sess, err := newAWSSession(options)
+	if err != nil {
+		return nil, err
+	}
+	logCallerIdentity(sess, options)
+
+	config := &aws.Config{}
+	if options.ec2Endpoint != "" {
+		config.Endpoint = aws.String(options.ec2Endpoint)
+	}
+	return &ebsClient{ec2: ec2.New(sess, config)}, nil
+}
+
+// createTags sets the same tags on several volumes with a single request.
+func (c *ebsClient) createTags(volumes []string, tags []*ec2.Tag) error {
 
 	input := &ec2.CreateTagsInput{
-		Resources: []*string{volume},
+		Resources: aws.StringSlice(volumes),
 		Tags:      tags,
 	}
-	_, err := ec2Client.CreateTags(input)
+	start := time.Now()
+	_, err := c.ec2.CreateTags(input)
+	observeEBSTagRequest(ec2OperationCreateTags, err, time.Since(start))
 	if err != nil {
 		return fmt.Errorf("failed to create ebs tags: %v", err)
 	}
 	return nil
 }
 
-func getRegion() string {
-	var region string
-	svc := ec2metadata.New(session.New())
-	if r, err := svc.Region(); err == nil {
-		region = r
+// deleteTags deletes the tags of the given keys from several volumes with a single request,
+// whatever their values.
+func (c *ebsClient) deleteTags(volumes []string, keys []string) error {
+
+	input := &ec2.DeleteTagsInput{
+		Resources: aws.StringSlice(volumes),
+	}
+	for _, key := range keys {
+		input.Tags = append(input.Tags, &ec2.Tag{Key: aws.String(key)})
+	}
+	start := time.Now()
+	_, err := c.ec2.DeleteTags(input)
+	observeEBSTagRequest(ec2OperationDeleteTags, err, time.Since(start))
+	if err != nil {
+		return fmt.Errorf("failed to delete ebs tags: %v", err)
+	}
+	return nil
+}
+
+// describeTags returns the tags of several volumes, by volume ID. Volumes without tags are
+// missing from the result.
+func (c *ebsClient) describeTags(volumes []string) (map[string]map[string]string, error) {
+
+	input := &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("resource-id"),
+			Values: aws.StringSlice(volumes),
+		}},
+	}
+	tags := make(map[string]map[string]string)
+	start := time.Now()
+	err := c.ec2.DescribeTagsPages(input, func(page *ec2.DescribeTagsOutput, lastPage bool) bool {
+		for _, tag := range page.Tags {
+			volume := aws.StringValue(tag.ResourceId)
+			if tags[volume] == nil {
+				tags[volume] = make(map[string]string)
+			}
+			tags[volume][aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		return true
+	})
+	observeEBSTagRequest(ec2OperationDescribeTags, err, time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe ebs tags: %v", err)
+	}
+	return tags, nil
+}
+
+// diffEBSTags compares the current tags of a volume with the desired ones. It returns the tags to
+// create or update, sorted by key, the managed keys to delete, and the keys managed once done. A key is only
+// managed if the tagger created it, so that tags set by other tools or by the provisioner are
+// never deleted, even if the annotation also sets them.
+func diffEBSTags(current map[string]string, desired []*ec2.Tag, managed []string) ([]*ec2.Tag, []string, []string) {
+	wasManaged := make(map[string]bool)
+	for _, key := range managed {
+		wasManaged[key] = true
+	}
+
+	var create []*ec2.Tag
+	var remove, owned []string
+	wanted := make(map[string]bool)
+	for _, tag := range desired {
+		key, value := aws.StringValue(tag.Key), aws.StringValue(tag.Value)
+		wanted[key] = true
+		currentValue, exists := current[key]
+		if !exists || currentValue != value {
+			create = append(create, tag)
+		}
+		if !exists || wasManaged[key] {
+			owned = append(owned, key)
+		}
+	}
+	for _, key := range managed {
+		if _, exists := current[key]; exists && !wanted[key] {
+			remove = append(remove, key)
+		}
+	}
+
+	sort.Slice(create, func(i, j int) bool {
+		return aws.StringValue(create[i].Key) < aws.StringValue(create[j].Key)
+	})
+	sort.Strings(remove)
+	sort.Strings(owned)
+	return create, remove, owned
+}
+
+// formatEBSTags formats tags as in the ebs-additional-resource-tags annotation.
+func formatEBSTags(tags []*ec2.Tag) string {
+	items := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		items = append(items, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+	}
+	return strings.Join(items, ",")
+}
+
+// awsErrorCode returns the code of an AWS API error, e.g. UnauthorizedOperation, or "Unknown"
+// for other errors.
+func awsErrorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
 	}
-	return region
+	return "Unknown"
 }
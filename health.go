@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// healthChecker serves the liveness and readiness endpoints of the k8s-metadata-injector.
+type healthChecker struct {
+	mu           sync.RWMutex
+	checks       []readinessCheck
+	shuttingDown bool
+}
+
+// readinessCheck is a named condition that has to hold for the server to be ready. The result
+// of informational checks is reported but does not affect readiness.
+type readinessCheck struct {
+	name          string
+	check         func() error
+	informational bool
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{}
+}
+
+// AddReadinessCheck adds a condition evaluated on every readiness probe.
+func (h *healthChecker) AddReadinessCheck(name string, check func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, readinessCheck{name: name, check: check})
+}
+
+// AddInformationalCheck adds a condition reported on every readiness probe without affecting
+// readiness, for conditions that depend on the server being ready in the first place.
+func (h *healthChecker) AddInformationalCheck(name string, check func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, readinessCheck{name: name, check: check, informational: true})
+}
+
+// SetShuttingDown makes the server report not ready so that it is removed
+// from the Service endpoints before the webhook server is stopped.
+func (h *healthChecker) SetShuttingDown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shuttingDown = true
+}
+
+func (h *healthChecker) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+}
+
+func (h *healthChecker) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var report bytes.Buffer
+	ready := true
+
+	if h.shuttingDown {
+		ready = false
+		fmt.Fprintln(&report, "[-]shutdown failed: server is shutting down")
+	}
+
+	for _, c := range h.checks {
+		if err := c.check(); err != nil && c.informational {
+			fmt.Fprintf(&report, "[-]%s failed (informational): %v\n", c.name, err)
+		} else if err != nil {
+			ready = false
+			fmt.Fprintf(&report, "[-]%s failed: %v\n", c.name, err)
+		} else {
+			fmt.Fprintf(&report, "[+]%s ok\n", c.name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, report.String())
+		fmt.Fprint(w, "readyz check failed")
+		return
+	}
+	fmt.Fprint(w, report.String())
+	fmt.Fprint(w, "ok")
+}
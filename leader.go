@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+// leaderStopTimeout is how long the shutdown waits for the leader-elected controllers to stop
+// and release their Lease.
+const leaderStopTimeout = 10 * time.Second
+
+// leaderElectionTimings are the durations of the leader election, see
+// leaderelection.LeaderElectionConfig.
+type leaderElectionTimings struct {
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// electedController is a controller run by a leaderElectedController: the ebs-tagger controller
+// or the reconciler.
+type electedController interface {
+	Run(threadiness int, stopCh <-chan struct{})
+	checkCacheSync() error
+}
+
+// leaderElectedController runs a controller only in the replica holding the leader election
+// Lease, so that a single replica tags the volumes or reconciles the objects while all of them
+// serve admission requests. A new controller is started each time the Lease is acquired.
+type leaderElectedController struct {
+	component     string
+	config        leaderelection.LeaderElectionConfig
+	identity      string
+	threadiness   int
+	leader        prometheus.Gauge
+	newController func() electedController
+
+	mu         sync.RWMutex
+	controller electedController
+}
+
+// newLeaderElectedController returns a leaderElectedController for the given component, e.g.
+// "ebs-tagger", using the Lease namespace/name. leader is set to 1 while the controller runs.
+func newLeaderElectedController(kubeclientset kubernetes.Interface, recorder record.EventRecorder, namespace string, name string, component string, leader prometheus.Gauge, timings leaderElectionTimings, threadiness int, newController func() electedController) (*leaderElectedController, error) {
+	identity, err := replicaIdentity()
+	if err != nil {
+		return nil, err
+	}
+	c := &leaderElectedController{
+		component:     component,
+		identity:      identity,
+		threadiness:   threadiness,
+		leader:        leader,
+		newController: newController,
+	}
+	c.config = leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+			Client: kubeclientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity:      identity,
+				EventRecorder: recorder,
+			},
+		},
+		LeaseDuration: timings.leaseDuration,
+		RenewDeadline: timings.renewDeadline,
+		RetryPeriod:   timings.retryPeriod,
+		// Release the Lease on shutdown so that another replica takes over without waiting for it
+		// to expire.
+		ReleaseOnCancel: true,
+		Name:            name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			// OnStartedLeading is set for each term by newElector. OnStoppedLeading is also called
+			// when the Lease was never acquired, the controller logs when it stops.
+			OnStoppedLeading: func() {},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					klog.Infof("The %s runs in %s", component, leader)
+				}
+			},
+		},
+	}
+	// Validate the configuration, the elector itself is created for each term.
+	if _, err := c.newElector(&leaderTerm{}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// leaderTerm is a single run for the leader election, during which the controller is started at
+// most once.
+type leaderTerm struct {
+	mu      sync.Mutex
+	over    bool
+	running bool
+	done    chan struct{}
+}
+
+func (c *leaderElectedController) newElector(term *leaderTerm) (*leaderelection.LeaderElector, error) {
+	config := c.config
+	config.Callbacks.OnStartedLeading = func(ctx context.Context) {
+		c.lead(ctx, term)
+	}
+	return leaderelection.NewLeaderElector(config)
+}
+
+// Run takes part in the leader election until stopCh is closed. When the Lease is lost, the
+// replica waits for the controller to stop before trying to acquire the Lease again, so that two
+// controllers never run at the same time in a replica.
+func (c *leaderElectedController) Run(stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	for {
+		term := &leaderTerm{done: make(chan struct{})}
+		elector, err := c.newElector(term)
+		if err != nil {
+			klog.Errorf("Failed to create the %s leader elector: %v", c.component, err)
+			return
+		}
+		elector.Run(ctx)
+		term.end()
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		klog.Warningf("Lost the %s leader election, it is stopped until the Lease is acquired again", c.component)
+	}
+}
+
+// end waits for the controller started during the term, if any, to stop. The elector starts it
+// in a goroutine which may not have run yet, it then returns without starting the controller.
+func (t *leaderTerm) end() {
+	t.mu.Lock()
+	t.over = true
+	running := t.running
+	t.mu.Unlock()
+	if running {
+		<-t.done
+	}
+}
+
+func (c *leaderElectedController) lead(ctx context.Context, term *leaderTerm) {
+	term.mu.Lock()
+	if term.over {
+		term.mu.Unlock()
+		return
+	}
+	term.running = true
+	term.mu.Unlock()
+	defer close(term.done)
+
+	klog.Infof("Acquired the %s leader election as %s", c.component, c.identity)
+	controller := c.newController()
+	c.setController(controller)
+	c.leader.Set(1)
+	defer func() {
+		c.leader.Set(0)
+		c.setController(nil)
+	}()
+	controller.Run(c.threadiness, ctx.Done())
+}
+
+func (c *leaderElectedController) setController(controller electedController) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.controller = controller
+}
+
+// current returns the controller running in this replica, or nil if it is not leading.
+func (c *leaderElectedController) current() electedController {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.controller
+}
+
+// checkCacheSync reports whether the informer caches of the controller have synced. Replicas
+// which are not leading are ready, they only serve admission requests.
+func (c *leaderElectedController) checkCacheSync() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.controller == nil {
+		return nil
+	}
+	return c.controller.checkCacheSync()
+}
+
+// waitGroupTimeout waits for wg until timeout, and reports whether it is done.
+func waitGroupTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// deregisterNever keeps the webhook registered on exit.
+	deregisterNever = "never"
+	// deregisterLastReplica deregisters the webhook when no other replica holds a Lease.
+	deregisterLastReplica = "last-replica"
+	// deregisterAlways deregisters the webhook whenever a replica exits.
+	deregisterAlways = "always"
+
+	replicaLeaseDuration    = 60 * time.Second
+	replicaLeaseRenewPeriod = 20 * time.Second
+	// replicaLeaseGCAge is the time after which the expired Lease of a replica which crashed or
+	// was killed without releasing it is deleted by the other replicas.
+	replicaLeaseGCAge = 10 * time.Minute
+
+	// replicaLeaseLabel is set on the replica Leases to the name of the MutatingWebhookConfiguration.
+	replicaLeaseLabel = "k8s-metadata-injector.kubernetes.io/webhook-config"
+)
+
+// replicaLease is a coordination Lease held by each running replica of the webhook, so that the
+// last replica shutting down knows it can deregister the webhook, and replicas of different
+// registration revisions know which of them are still running.
+type replicaLease struct {
+	clientset         kubernetes.Interface
+	namespace         string
+	name              string
+	identity          string
+	webhookConfigName string
+
+	mu       sync.Mutex
+	released bool
+}
+
+func newReplicaLease(clientset kubernetes.Interface, namespace string, webhookConfigName string) (*replicaLease, error) {
+	identity, err := replicaIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return &replicaLease{
+		clientset:         clientset,
+		namespace:         namespace,
+		name:              webhookConfigName + "-" + identity,
+		identity:          identity,
+		webhookConfigName: webhookConfigName,
+	}, nil
+}
+
+// Run acquires the Lease and renews it until stopCh is closed, deleting the Leases left expired
+// by other replicas.
+func (l *replicaLease) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := l.renew(); err != nil {
+			glog.Errorf("Failed to renew replica Lease %s/%s: %v", l.namespace, l.name, err)
+		}
+		if err := l.collectExpired(); err != nil {
+			glog.Errorf("Failed to delete expired replica Leases: %v", err)
+		}
+	}, replicaLeaseRenewPeriod, stopCh)
+}
+
+func (l *replicaLease) renew() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return nil
+	}
+
+	client := l.clientset.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(replicaLeaseDuration.Seconds())
+
+	lease, err := client.Get(l.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = client.Create(&coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        l.name,
+				Namespace:   l.namespace,
+				Labels:      map[string]string{replicaLeaseLabel: l.webhookConfigName},
+				Annotations: map[string]string{registrationRevisionAnnotation: registrationRevision},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+	lease.Annotations[registrationRevisionAnnotation] = registrationRevision
+	lease.Spec.HolderIdentity = &l.identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	_, err = client.Update(lease)
+	return err
+}
+
+// release deletes the Lease of this replica.
+func (l *replicaLease) release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.released = true
+	err := l.clientset.CoordinationV1().Leases(l.namespace).Delete(l.name, &metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// otherHolders returns the identities of the other replicas holding an unexpired Lease, only
+// those running the given registration revision unless it is empty.
+func (l *replicaLease) otherHolders(revision string) ([]string, error) {
+	leases, err := l.list()
+	if err != nil {
+		return nil, err
+	}
+	var holders []string
+	for _, lease := range leases {
+		if lease.Name == l.name || time.Now().After(leaseExpiry(&lease)) {
+			continue
+		}
+		if revision != "" && lease.Annotations[registrationRevisionAnnotation] != revision {
+			continue
+		}
+		holder := lease.Name
+		if lease.Spec.HolderIdentity != nil {
+			holder = *lease.Spec.HolderIdentity
+		}
+		holders = append(holders, holder)
+	}
+	return holders, nil
+}
+
+// collectExpired deletes the Leases of the other replicas expired for longer than
+// replicaLeaseGCAge. The deletion is skipped if the Lease was renewed in the meantime.
+func (l *replicaLease) collectExpired() error {
+	leases, err := l.list()
+	if err != nil {
+		return err
+	}
+	client := l.clientset.CoordinationV1().Leases(l.namespace)
+	for _, lease := range leases {
+		if lease.Name == l.name || time.Now().Before(leaseExpiry(&lease).Add(replicaLeaseGCAge)) {
+			continue
+		}
+		resourceVersion := lease.ResourceVersion
+		err := client.Delete(lease.Name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &lease.UID, ResourceVersion: &resourceVersion},
+		})
+		if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			return err
+		}
+		if err == nil {
+			glog.Infof("Deleted expired replica Lease %s/%s", l.namespace, lease.Name)
+		}
+	}
+	return nil
+}
+
+// list returns the replica Leases of the webhook.
+func (l *replicaLease) list() ([]coordinationv1.Lease, error) {
+	selector := labels.SelectorFromSet(labels.Set{replicaLeaseLabel: l.webhookConfigName})
+	leases, err := l.clientset.CoordinationV1().Leases(l.namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	return leases.Items, nil
+}
+
+// leaseExpiry returns the time a Lease expires at, or the zero time if it was never renewed.
+func leaseExpiry(lease *coordinationv1.Lease) time.Time {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return time.Time{}
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+}
+
+// replicaIdentity identifies this replica in Leases: the pod name set through POD_NAME, or the
+// hostname.
+func replicaIdentity() (string, error) {
+	if identity := os.Getenv("POD_NAME"); identity != "" {
+		return identity, nil
+	}
+	return os.Hostname()
+}
+
+// validateDeregisterPolicy checks a --deregister-on-exit value.
+func validateDeregisterPolicy(policy string) error {
+	switch policy {
+	case deregisterNever, deregisterLastReplica, deregisterAlways:
+		return nil
+	}
+	return fmt.Errorf("unsupported deregister-on-exit policy %q", policy)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestLease returns a replica Lease of the webhook renewed at renewTime.
+func newTestLease(identity string, webhookConfigName string, revision string, renewTime time.Time) *coordinationv1.Lease {
+	duration := int32(replicaLeaseDuration.Seconds())
+	renew := metav1.NewMicroTime(renewTime)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        webhookConfigName + "-" + identity,
+			Namespace:   "kube-system",
+			Labels:      map[string]string{replicaLeaseLabel: webhookConfigName},
+			Annotations: map[string]string{registrationRevisionAnnotation: revision},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &identity,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &renew,
+		},
+	}
+}
+
+func TestReplicaLeaseOtherHolders(t *testing.T) {
+	now := time.Now()
+	clientset := fake.NewSimpleClientset(
+		newTestLease("self", "injector", registrationRevision, now),
+		newTestLease("running", "injector", registrationRevision, now),
+		newTestLease("previous", "injector", "other", now),
+		newTestLease("expired", "injector", registrationRevision, now.Add(-2*replicaLeaseDuration)),
+		newTestLease("other-webhook", "other-injector", registrationRevision, now),
+	)
+	lease := &replicaLease{
+		clientset:         clientset,
+		namespace:         "kube-system",
+		name:              "injector-self",
+		identity:          "self",
+		webhookConfigName: "injector",
+	}
+
+	tests := []struct {
+		name     string
+		revision string
+		want     []string
+	}{
+		{name: "any revision", want: []string{"previous", "running"}},
+		{name: "this revision", revision: registrationRevision, want: []string{"running"}},
+		{name: "other revision", revision: "other", want: []string{"previous"}},
+		{name: "revision without replicas", revision: "unknown"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			holders, err := lease.otherHolders(test.revision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(holders)
+			if !reflect.DeepEqual(holders, test.want) {
+				t.Errorf("otherHolders(%q) = %v, want %v", test.revision, holders, test.want)
+			}
+		})
+	}
+}
+
+func TestReplicaLeaseCollectExpired(t *testing.T) {
+	now := time.Now()
+	clientset := fake.NewSimpleClientset(
+		newTestLease("self", "injector", registrationRevision, now.Add(-2*replicaLeaseGCAge)),
+		newTestLease("running", "injector", registrationRevision, now),
+		newTestLease("recently-expired", "injector", registrationRevision, now.Add(-2*replicaLeaseDuration)),
+		newTestLease("crashed", "injector", registrationRevision, now.Add(-2*replicaLeaseGCAge)),
+		newTestLease("other-webhook", "other-injector", registrationRevision, now.Add(-2*replicaLeaseGCAge)),
+	)
+	lease := &replicaLease{
+		clientset:         clientset,
+		namespace:         "kube-system",
+		name:              "injector-self",
+		identity:          "self",
+		webhookConfigName: "injector",
+	}
+
+	if err := lease.collectExpired(); err != nil {
+		t.Fatal(err)
+	}
+
+	leases, err := clientset.CoordinationV1().Leases("kube-system").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, lease := range leases.Items {
+		names = append(names, lease.Name)
+	}
+	sort.Strings(names)
+	want := []string{"injector-recently-expired", "injector-running", "injector-self", "other-injector-other-webhook"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("remaining Leases %v, want %v", names, want)
+	}
+}
+
+func TestReplicaLeaseRenewRecordsRevision(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	lease := &replicaLease{
+		clientset:         clientset,
+		namespace:         "kube-system",
+		name:              "injector-self",
+		identity:          "self",
+		webhookConfigName: "injector",
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := lease.renew(); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := clientset.CoordinationV1().Leases("kube-system").Get("injector-self", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revision := stored.Annotations[registrationRevisionAnnotation]; revision != registrationRevision {
+			t.Errorf("renewal %d: revision %q, want %q", i, revision, registrationRevision)
+		}
+		if time.Now().After(leaseExpiry(stored)) {
+			t.Errorf("renewal %d: Lease expired at %v", i, leaseExpiry(stored))
+		}
+	}
+
+	if err := lease.release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lease.renew(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoordinationV1().Leases("kube-system").Get("injector-self", metav1.GetOptions{}); err == nil {
+		t.Error("a released Lease was acquired again")
+	}
+}
@@ -1,28 +1,80 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"k8s.io/klog"
 
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
-	master              = flag.String("master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
-	kubeConfig          = flag.String("kubeConfig", "", "Path to a kube config. Only required if out-of-cluster.")
-	webhookConfigName   = flag.String("webhook-config-name", "k8s-metadata-injector", "The name of the MutatingWebhookConfiguration object to create.")
-	webhookCertDir      = flag.String("webhook-cert-dir", "/etc/webhook/certs/", "The directory where x509 certificate and key files are stored.")
-	webhookSvcNamespace = flag.String("webhook-svc-namespace", "kube-system", "The namespace of the Service for the webhook server.")
-	webhookSvcName      = flag.String("webhook-svc-name", "k8s-metadata-injector", "The name of the Service for the webhook server.")
-	webhookPort         = flag.Int("webhook-port", 8080, "Service port of the webhook server.")
-	metadataConfigFile  = flag.String("metadata-config-file", "/etc/webhook/config/metadataconfig.yaml", "File containing the metadata configuration.")
-	ebsTagging          = flag.Bool("ebs-tagging", false, "Enable AWS EBS tagging.")
+	master               = flag.String("master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	kubeConfig           = flag.String("kubeConfig", "", "Path to a kube config. Only required if out-of-cluster.")
+	webhookConfigName    = flag.String("webhook-config-name", "k8s-metadata-injector", "The name of the MutatingWebhookConfiguration object to create.")
+	webhookCertDir       = flag.String("webhook-cert-dir", "/etc/webhook/certs/", "The directory where x509 certificate and key files are stored.")
+	webhookCertSecret    = flag.String("webhook-cert-secret", "", "Name of a Secret, in the webhook service namespace, holding the certificate files. Overrides webhook-cert-dir if set.")
+	certBootstrap        = flag.String("cert-bootstrap", "", "Issue the webhook certificate and store it in the Secret set by webhook-cert-secret (the webhook service name if empty): \"self-signed\" to sign it with a generated CA, or \"csr\" to use the CertificateSigningRequest API.")
+	certRenewBefore      = flag.Duration("cert-renew-before", 30*24*time.Hour, "Time before expiry at which a bootstrapped webhook certificate is renewed.")
+	certCSRTimeout       = flag.Duration("cert-csr-timeout", 10*time.Minute, "Time to wait for a CertificateSigningRequest issued with cert-bootstrap=csr to be approved and signed.")
+	certReloadInterval   = flag.Duration("cert-reload-interval", 10*time.Minute, "Period at which the webhook certificate is reloaded from its source, in addition to the reloads when the watched files or Secret change, and bootstrapped certificates are checked for renewal.")
+	webhookSvcNamespace  = flag.String("webhook-svc-namespace", "kube-system", "The namespace of the Service for the webhook server.")
+	webhookSvcName       = flag.String("webhook-svc-name", "k8s-metadata-injector", "The name of the Service for the webhook server.")
+	webhookURL           = flag.String("webhook-url", "", "Register the webhook with this https URL instead of the Service, to run out of the cluster during development, e.g. https://host.docker.internal:8080/serve. A self-signed certificate is generated for its host unless cert-bootstrap or webhook-cert-secret is set.")
+	webhookPort          = flag.Int("webhook-port", 8080, "Service port of the webhook server.")
+	metadataConfigFile   = flag.String("metadata-config-file", "/etc/webhook/config/metadataconfig.yaml", "File containing the metadata configuration.")
+	configReloadInterval = flag.Duration("config-reload-interval", 30*time.Second, "Period at which the metadata configuration file is checked for changes.")
+	ebsTagging           = flag.Bool("ebs-tagging", false, "Enable AWS EBS tagging.")
+	ebsCSIDrivers        = flag.String("ebs-csi-drivers", "ebs.csi.aws.com", "Comma-separated list of CSI drivers whose volumes are EBS volumes tagged by the ebs-tagger, with the volume ID as volumeHandle.")
+	awsRegion            = flag.String("aws-region", "", "AWS region of the EBS volumes. Taken from AWS_REGION, the shared config or the instance metadata if empty.")
+	awsEC2Endpoint       = flag.String("aws-ec2-endpoint", "", "Custom EC2 endpoint URL, e.g. of a LocalStack-style stand-in for testing.")
+	awsSTSEndpoint       = flag.String("aws-sts-endpoint", "", "Custom STS endpoint URL, used to assume a role with a web identity and to log the AWS identity at startup.")
+	awsIMDS              = flag.String("aws-imds", imdsV2, "How the EC2 instance metadata service is called for the region and credentials: \"v2\" with session tokens, falling back to IMDSv1, \"v1\", or \"disabled\" to run off EC2.")
+	awsProfile           = flag.String("aws-profile", "", "AWS shared config profile to use for credentials.")
+	awsRoleARN           = flag.String("aws-role-arn", os.Getenv("AWS_ROLE_ARN"), "ARN of the role to assume with the token of aws-web-identity-token-file, e.g. for IAM roles for service accounts.")
+	awsWebIdentityToken  = flag.String("aws-web-identity-token-file", os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), "File containing the web identity token used to assume aws-role-arn, read again when the credentials expire.")
+	awsMaxRetries        = flag.Int("aws-max-retries", 3, "Maximum number of retries of a failed AWS request.")
+	awsRetryBaseDelay    = flag.Duration("aws-retry-base-delay", 100*time.Millisecond, "Delay before the first retry of a failed AWS request, doubled on each retry.")
+	awsRetryMaxDelay     = flag.Duration("aws-retry-max-delay", 20*time.Second, "Maximum delay between retries of a failed AWS request.")
+	leaderElect          = flag.Bool("leader-elect", true, "Run the ebs-tagger controller and the reconciler only in the replica holding their leader election Lease, in the webhook service namespace. All replicas serve admission requests.")
+	leaderElectLeaseName = flag.String("leader-elect-lease-name", "k8s-metadata-injector-ebs-tagger", "Name of the leader election Lease of the ebs-tagger controller.")
+	leaseDuration        = flag.Duration("leader-elect-lease-duration", 15*time.Second, "Duration for which non-leader replicas wait before trying to acquire an unrenewed leader election Lease.")
+	renewDeadline        = flag.Duration("leader-elect-renew-deadline", 10*time.Second, "Duration during which the leader retries renewing the leader election Lease before it stops the ebs-tagger controller.")
+	retryPeriod          = flag.Duration("leader-elect-retry-period", 2*time.Second, "Period at which replicas try to acquire or renew the leader election Lease.")
+	metricsPort          = flag.Int("metrics-port", 9090, "Port of the plain HTTP server exposing Prometheus metrics and the health endpoints.")
+	backfill             = flag.Bool("backfill", false, "Patch existing objects with the configured metadata and exit, instead of serving the admission webhook.")
+	backfillNamespaces   = flag.String("backfill-namespaces", "", "Comma-separated list of namespaces to backfill. All namespaces if empty.")
+	backfillKinds        = flag.String("backfill-kinds", "Pod,Service,PersistentVolumeClaim", "Comma-separated list of kinds to backfill.")
+	backfillQPS          = flag.Float64("backfill-qps", 5, "Maximum number of API requests per second issued by the backfill.")
+	backfillBurst        = flag.Int("backfill-burst", 10, "Maximum burst of API requests issued by the backfill.")
+	backfillPageSize     = flag.Int64("backfill-page-size", 500, "Number of objects listed per page by the backfill.")
+	backfillDryRun       = flag.Bool("backfill-dry-run", false, "Report the objects the backfill would patch without patching them.")
+	backfillCheckpoint   = flag.String("backfill-checkpoint", "k8s-metadata-injector-backfill", "Name of the ConfigMap, in the webhook service namespace, storing the backfill progress so that an interrupted run resumes. Disabled if empty.")
+	reconcile            = flag.Bool("reconcile", false, "Enable the reconciler re-patching objects whose injected metadata drifted from the configuration.")
+	reconcileResync      = flag.Duration("reconcile-resync-period", 10*time.Minute, "Period at which the reconciler checks all objects again.")
+	reconcileExcluded    = flag.String("reconcile-excluded-namespaces", "", "Comma-separated list of namespaces the reconciler leaves untouched.")
+	reconcileLeaseName   = flag.String("reconcile-leader-elect-lease-name", "k8s-metadata-injector-reconciler", "Name of the leader election Lease of the reconciler.")
+	selfTestNamespace    = flag.String("self-test-namespace", "default", "Namespace where the webhook self-test creates its canary object with dryRun=All. Disabled if empty.")
+	selfTestKind         = flag.String("self-test-kind", "PersistentVolumeClaim", "Kind of the canary object created by the webhook self-test.")
+	selfTestInterval     = flag.Duration("self-test-interval", 5*time.Minute, "Period at which the webhook self-test runs after startup. Only at startup if 0.")
+	tlsMinVersion        = flag.String("tls-min-version", "VersionTLS12", "Minimum TLS version accepted by the webhook server: VersionTLS10, VersionTLS11, VersionTLS12 or VersionTLS13.")
+	tlsCipherSuites      = flag.String("tls-cipher-suites", "", "Comma-separated list of cipher suites accepted by the webhook server for TLS 1.2 and earlier, using IANA names. Go defaults if empty.")
+	tlsClientCAFile      = flag.String("tls-client-ca-file", "", "If set, the webhook server requires a client certificate signed by a CA of this file, e.g. the one presented by the API server through its admission control kubeconfig.")
+	deregisterOnExit     = flag.String("deregister-on-exit", deregisterLastReplica, "When to delete the MutatingWebhookConfiguration on exit: \"last-replica\" when no other replica holds a Lease, \"always\" or \"never\".")
+	shutdownDelay        = flag.Duration("shutdown-delay", 5*time.Second, "Time to keep serving after reporting not ready on shutdown, so that the Service endpoints drain.")
 )
 
 func main() {
@@ -54,36 +106,308 @@ func main() {
 		klog.Fatalf("Error building kubernetes clientset: %s", err.Error())
 	}
 
+	if *backfill {
+		metadataConfig, err := loadConfig(*metadataConfigFile)
+		if err == nil {
+			err = metadataConfig.Validate()
+		}
+		if err != nil {
+			klog.Fatalf("Failed to load configuration: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		signalCh := make(chan os.Signal, 1)
+		signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signalCh
+			cancel()
+		}()
+
+		err = runBackfill(ctx, kubeClient, metadataConfig, backfillOptions{
+			namespaces:          splitList(*backfillNamespaces),
+			kinds:               splitList(*backfillKinds),
+			qps:                 float32(*backfillQPS),
+			burst:               *backfillBurst,
+			pageSize:            *backfillPageSize,
+			dryRun:              *backfillDryRun,
+			checkpointNamespace: *webhookSvcNamespace,
+			checkpointName:      *backfillCheckpoint,
+		})
+		if err != nil {
+			klog.Fatalf("Backfill failed: %v", err)
+		}
+		return
+	}
+
+	health := newHealthChecker()
+	metricsServer := startMetricsServer(*metricsPort, health)
+
 	stopCh := make(chan struct{})
 
+	recorder := newEventRecorder(kubeClient)
+	// elected tracks the leader-elected controllers, which release their Lease on exit.
+	var elected sync.WaitGroup
+	timings := leaderElectionTimings{
+		leaseDuration: *leaseDuration,
+		renewDeadline: *renewDeadline,
+		retryPeriod:   *retryPeriod,
+	}
+
 	if *ebsTagging == true {
-		controller := NewController(kubeClient)
-		go controller.Run(2, stopCh)
+		ebs, err := newEBSClient(awsOptions{
+			region:               *awsRegion,
+			ec2Endpoint:          *awsEC2Endpoint,
+			stsEndpoint:          *awsSTSEndpoint,
+			imds:                 *awsIMDS,
+			profile:              *awsProfile,
+			roleARN:              *awsRoleARN,
+			webIdentityTokenFile: *awsWebIdentityToken,
+			maxRetries:           *awsMaxRetries,
+			retryBaseDelay:       *awsRetryBaseDelay,
+			retryMaxDelay:        *awsRetryMaxDelay,
+		})
+		if err != nil {
+			klog.Fatalf("Failed to configure the AWS client: %v", err)
+		}
+		if *leaderElect {
+			controller, err := newLeaderElectedController(kubeClient, recorder, *webhookSvcNamespace, *leaderElectLeaseName, "ebs-tagger", ebsTaggerLeader, timings, 2, func() electedController {
+				return NewController(kubeClient, recorder, ebs, splitList(*ebsCSIDrivers))
+			})
+			if err != nil {
+				klog.Fatalf("Failed to configure the ebs-tagger leader election: %v", err)
+			}
+			health.AddReadinessCheck("ebs-tagger", controller.checkCacheSync)
+			elected.Add(1)
+			go func() {
+				defer elected.Done()
+				controller.Run(stopCh)
+			}()
+		} else {
+			controller := NewController(kubeClient, recorder, ebs, splitList(*ebsCSIDrivers))
+			health.AddReadinessCheck("ebs-tagger", controller.checkCacheSync)
+			go controller.Run(2, stopCh)
+		}
 	}
 
-	metadataConfig, err := loadConfig(*metadataConfigFile)
+	// An invalid or missing configuration does not prevent the webhook from starting: it is
+	// reloaded until it becomes valid, while admission requests are allowed unchanged.
+	configs := newConfigStore(*metadataConfigFile, recorder, podReference())
+	go configs.Run(*configReloadInterval, stopCh)
+
+	namespaces := newNamespaceCache(kubeClient)
+	health.AddReadinessCheck("namespaces", namespaces.checkCacheSync)
+	go namespaces.Run(stopCh)
+
+	if *reconcile {
+		newReconciler := func() *Reconciler {
+			return NewReconciler(kubeClient, configs, namespaces, *reconcileResync, splitList(*reconcileExcluded))
+		}
+		if *leaderElect {
+			controller, err := newLeaderElectedController(kubeClient, recorder, *webhookSvcNamespace, *reconcileLeaseName, "reconciler", reconcilerLeader, timings, 2, func() electedController {
+				return newReconciler()
+			})
+			if err != nil {
+				klog.Fatalf("Failed to configure the reconciler leader election: %v", err)
+			}
+			configs.OnChange(func(config *MetadataConfig) {
+				if reconciler, ok := controller.current().(*Reconciler); ok {
+					reconciler.configChanged(config)
+				}
+			})
+			health.AddReadinessCheck("reconciler", controller.checkCacheSync)
+			elected.Add(1)
+			go func() {
+				defer elected.Done()
+				controller.Run(stopCh)
+			}()
+		} else {
+			reconciler := newReconciler()
+			configs.OnChange(reconciler.configChanged)
+			health.AddReadinessCheck("reconciler", reconciler.checkCacheSync)
+			go reconciler.Run(2, stopCh)
+		}
+	}
+
+	var hookURL *url.URL
+	if *webhookURL != "" {
+		if hookURL, err = parseWebhookURL(*webhookURL); err != nil {
+			klog.Fatal(err)
+		}
+	}
+
+	source, err := newCertSource(kubeClient, cfg, hookURL)
+	if err != nil {
+		klog.Fatalf("Failed to configure the webhook certificate: %v", err)
+	}
+	certs, err := newCertReloader(source)
+	if err != nil {
+		klog.Fatalf("Failed to load the webhook certificate: %v", err)
+	}
+
+	tlsOpts, err := newTLSOptions(*tlsMinVersion, splitList(*tlsCipherSuites), *tlsClientCAFile)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	hook, err := NewWebhook(kubeClient, certs, tlsOpts, *webhookSvcNamespace, *webhookSvcName, *webhookPort, configs, namespaces)
 	if err != nil {
-		klog.Errorf("Filed to load configuration: %v", err)
+		klog.Fatal(err)
+	}
+
+	if hookURL != nil {
+		hook.SetURL(hookURL)
 	}
 
-	hook, err := NewWebhook(kubeClient, *webhookCertDir, *webhookSvcNamespace, *webhookSvcName, *webhookPort, metadataConfig)
+	if err := validateDeregisterPolicy(*deregisterOnExit); err != nil {
+		klog.Fatal(err)
+	}
+	lease, err := newReplicaLease(kubeClient, *webhookSvcNamespace, *webhookConfigName)
 	if err != nil {
 		klog.Fatal(err)
 	}
+	hook.SetDeregisterPolicy(*deregisterOnExit, lease)
+
+	health.AddReadinessCheck("tls", hook.checkCertificate)
+	health.AddReadinessCheck("config", hook.checkConfig)
+	health.AddReadinessCheck("registration", hook.checkRegistration)
 
 	if err = hook.Start(*webhookConfigName); err != nil {
 		klog.Fatal(err)
 	}
+	go certs.Run(*certReloadInterval, stopCh)
+
+	if hookURL != nil {
+		printURLModeSteps(hookURL)
+	}
+
+	if *selfTestNamespace != "" {
+		tester, err := newSelfTester(kubeClient, configs, namespaces, *selfTestNamespace, *selfTestKind)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		// The self-test goes through the Service, which only routes to ready replicas, so its
+		// result cannot gate readiness: a failure would remove all replicas from the endpoints.
+		health.AddInformationalCheck("self-test", tester.check)
+		go tester.Run(*selfTestInterval, stopCh)
+	}
 
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 	<-signalCh
 
+	// Report not ready first and keep everything running while the Service endpoints drain.
+	glog.Info("Shutting down the k8s-metadata-injector")
+	health.SetShuttingDown()
+	time.Sleep(*shutdownDelay)
+
 	close(stopCh)
 
-	glog.Info("Shutting down the k8s-metadata-injector")
+	// Wait for the leader-elected controllers to stop and release their Lease, so that another
+	// replica takes over right away.
+	if !waitGroupTimeout(&elected, leaderStopTimeout) {
+		glog.Warningf("The leader-elected controllers did not stop within %v", leaderStopTimeout)
+	}
+
 	if err := hook.Stop(*webhookConfigName); err != nil {
 		klog.Fatal(err)
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		klog.Error(err)
+	}
+
+}
+
+// newCertSource returns the source of the webhook certificate selected by the flags. With a
+// webhook URL, the certificate is issued for the host of the URL instead of the Service.
+func newCertSource(kubeClient kubernetes.Interface, cfg *rest.Config, hookURL *url.URL) (certSource, error) {
+	secretName := *webhookCertSecret
+	if *certBootstrap != "" && secretName == "" {
+		secretName = *webhookSvcName
+	}
+	commonName := *webhookSvcName + "." + *webhookSvcNamespace + ".svc"
+	hostNames := serviceDNSNames(*webhookSvcName, *webhookSvcNamespace)
+	if hookURL != nil {
+		commonName = hookURL.Hostname()
+		hostNames = []string{hookURL.Hostname()}
+	}
+
+	var issuer certIssuer
+	switch *certBootstrap {
+	case "":
+		if secretName != "" {
+			return &secretCertSource{
+				clientset: kubeClient,
+				namespace: *webhookSvcNamespace,
+				name:      secretName,
+			}, nil
+		}
+		if hookURL != nil {
+			return newMemoryCertSource(hostNames)
+		}
+		return &certBundle{
+			serverCertFile: filepath.Join(*webhookCertDir, serverCertFile),
+			serverKeyFile:  filepath.Join(*webhookCertDir, serverKeyFile),
+			caCertFile:     filepath.Join(*webhookCertDir, caCertFile),
+		}, nil
+	case certBootstrapSelfSigned:
+		issuer = &selfSignedIssuer{
+			commonName: commonName,
+			published: func(caCert []byte) bool {
+				return caBundleRegistered(kubeClient, *webhookConfigName, caCert)
+			},
+		}
+	case certBootstrapCSR:
+		caBundle := cfg.TLSClientConfig.CAData
+		if len(caBundle) == 0 && cfg.TLSClientConfig.CAFile != "" {
+			var err error
+			if caBundle, err = readCertFile(cfg.TLSClientConfig.CAFile); err != nil {
+				return nil, err
+			}
+		}
+		issuer = &csrIssuer{clientset: kubeClient, commonName: commonName, caBundle: caBundle, timeout: *certCSRTimeout}
+	default:
+		return nil, fmt.Errorf("unknown cert-bootstrap mode %q", *certBootstrap)
+	}
+
+	return &bootstrapCertSource{
+		clientset:   kubeClient,
+		namespace:   *webhookSvcNamespace,
+		name:        secretName,
+		dnsNames:    hostNames,
+		renewBefore: *certRenewBefore,
+		issuer:      issuer,
+	}, nil
+}
+
+// printURLModeSteps prints what is needed for the API server to reach a webhook running out of
+// the cluster.
+func printURLModeSteps(hookURL *url.URL) {
+	port := hookURL.Port()
+	if port == "" {
+		port = "443"
+	}
+	fmt.Printf(`The webhook is registered with the URL %s.
+For the API server to reach it:
+  1. The host %q must resolve, from the API server, to this machine. With kind, use
+     host.docker.internal (Docker Desktop) or the gateway of the "kind" Docker network
+     (docker network inspect kind); with minikube, use host.minikube.internal.
+  2. The port %s of the URL must reach the webhook server listening on port %d, e.g. allow it
+     in the local firewall.
+  3. The serving certificate is issued for %q and its CA is registered with the webhook.
+Run the injector with -deregister-on-exit=always to remove the registration on exit.
+`, hookURL, hookURL.Hostname(), port, *webhookPort, hookURL.Hostname())
+}
+
+// splitList splits a comma-separated flag value, ignoring empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
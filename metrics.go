@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+const (
+	metricsNamespace = "k8s_metadata_injector"
+
+	admissionOutcomeMutated = "mutated"
+	admissionOutcomeAllowed = "allowed"
+	admissionOutcomeError   = "error"
+
+	skipReasonIgnoredNamespace  = "ignored_namespace"
+	skipReasonSkipAnnotation    = "skip_annotation"
+	skipReasonNoConfig          = "no_config"
+	skipReasonOperation         = "operation_not_handled"
+	skipReasonDeleting          = "deleting"
+	skipReasonNamespaceDisabled = "namespace_disabled"
+	skipReasonDegraded          = "degraded"
+
+	ec2OperationCreateTags   = "CreateTags"
+	ec2OperationDeleteTags   = "DeleteTags"
+	ec2OperationDescribeTags = "DescribeTags"
+)
+
+var (
+	admissionRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "admission",
+			Name:      "requests_total",
+			Help:      "Number of admission requests handled, by kind, namespace, operation and outcome.",
+		},
+		[]string{"kind", "namespace", "operation", "outcome"},
+	)
+
+	admissionMutateDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "admission",
+			Name:      "mutate_duration_seconds",
+			Help:      "Time spent computing the admission response, by kind and operation.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		},
+		[]string{"kind", "operation"},
+	)
+
+	admissionPatchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "admission",
+			Name:      "patch_size_bytes",
+			Help:      "Size of the JSON patch returned in mutating admission responses, by kind.",
+			Buckets:   prometheus.ExponentialBuckets(64, 2, 10),
+		},
+		[]string{"kind"},
+	)
+
+	admissionSkipsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "admission",
+			Name:      "skips_total",
+			Help:      "Number of admission requests that were not mutated, by reason.",
+		},
+		[]string{"reason"},
+	)
+
+	admissionDecodeFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "admission",
+			Name:      "decode_failures_total",
+			Help:      "Number of admission reviews or embedded objects that could not be decoded, by kind.",
+		},
+		[]string{"kind"},
+	)
+
+	reconcileDriftFoundTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "reconciler",
+			Name:      "drift_found_total",
+			Help:      "Number of objects found with metadata not matching the active configuration, by kind.",
+		},
+		[]string{"kind"},
+	)
+
+	reconcileDriftFixedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "reconciler",
+			Name:      "drift_fixed_total",
+			Help:      "Number of objects re-patched with the configured metadata, by kind.",
+		},
+		[]string{"kind"},
+	)
+
+	reconcileErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "reconciler",
+			Name:      "errors_total",
+			Help:      "Number of objects the reconciler gave up on after retries, by kind.",
+		},
+		[]string{"kind"},
+	)
+
+	configReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "config",
+			Name:      "reloads_total",
+			Help:      "Number of metadata configuration loads, by result.",
+		},
+		[]string{"result"},
+	)
+
+	configLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "config",
+			Name:      "last_reload_successful",
+			Help:      "Whether the last metadata configuration load was successful (1) or not (0).",
+		},
+	)
+
+	configLastReloadSuccessTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "config",
+			Name:      "last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful metadata configuration load.",
+		},
+	)
+
+	selfTestRunsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "self_test",
+			Name:      "runs_total",
+			Help:      "Number of webhook self-tests, by result (success, failure or skipped).",
+		},
+		[]string{"result"},
+	)
+
+	selfTestSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "self_test",
+			Name:      "success",
+			Help:      "Whether the last conclusive webhook self-test succeeded (1) or not (0).",
+		},
+	)
+
+	selfTestLastRunTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "self_test",
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Timestamp of the last webhook self-test.",
+		},
+	)
+
+	configDegraded = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "config",
+			Name:      "degraded",
+			Help:      "Whether no valid metadata configuration is loaded (1) and admission requests are allowed without mutation, or not (0).",
+		},
+	)
+
+	ebsTagRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "ebs_tagger",
+			Name:      "tag_requests_total",
+			Help:      "Number of EC2 tagging requests, by operation, result and AWS error code.",
+		},
+		[]string{"operation", "result", "code"},
+	)
+
+	ebsTagRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "ebs_tagger",
+			Name:      "tag_request_duration_seconds",
+			Help:      "Latency of the EC2 tagging requests, by operation.",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"operation"},
+	)
+
+	ebsTagRetriesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "ebs_tagger",
+			Name:      "retries_total",
+			Help:      "Number of volumes requeued after a tagging failure.",
+		},
+	)
+
+	ebsTagDroppedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "ebs_tagger",
+			Name:      "dropped_total",
+			Help:      "Number of volumes given up on after the maximum number of tagging retries.",
+		},
+	)
+
+	ebsTaggerLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "ebs_tagger",
+			Name:      "leader",
+			Help:      "Whether this replica holds the ebs-tagger leader election Lease and runs the controller (1) or not (0).",
+		},
+	)
+
+	reconcilerLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "reconciler",
+			Name:      "leader",
+			Help:      "Whether this replica holds the reconciler leader election Lease and runs the reconciler (1) or not (0).",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		admissionRequestsTotal,
+		admissionMutateDuration,
+		admissionPatchSize,
+		admissionSkipsTotal,
+		admissionDecodeFailuresTotal,
+		reconcileDriftFoundTotal,
+		reconcileDriftFixedTotal,
+		reconcileErrorsTotal,
+		configReloadsTotal,
+		configLastReloadSuccessful,
+		configLastReloadSuccessTimestamp,
+		configDegraded,
+		selfTestRunsTotal,
+		selfTestSuccess,
+		selfTestLastRunTimestamp,
+		ebsTagRequestsTotal,
+		ebsTagRequestDuration,
+		ebsTagRetriesTotal,
+		ebsTagDroppedTotal,
+		ebsTaggerLeader,
+		reconcilerLeader,
+	)
+
+	// The provider has to be set before any named queue is created.
+	workqueue.SetProvider(workqueueMetricsProvider{})
+}
+
+// observeAdmission records the outcome of a single admission request.
+func observeAdmission(req *admissionv1beta1.AdmissionRequest, resp *admissionv1beta1.AdmissionResponse, elapsed time.Duration) {
+	if req == nil {
+		return
+	}
+	kind := req.Kind.Kind
+	operation := string(req.Operation)
+
+	outcome := admissionOutcomeAllowed
+	if resp == nil || !resp.Allowed {
+		outcome = admissionOutcomeError
+	} else if len(resp.Patch) > 0 {
+		outcome = admissionOutcomeMutated
+		admissionPatchSize.WithLabelValues(kind).Observe(float64(len(resp.Patch)))
+	}
+
+	admissionRequestsTotal.WithLabelValues(kind, req.Namespace, operation, outcome).Inc()
+	admissionMutateDuration.WithLabelValues(kind, operation).Observe(elapsed.Seconds())
+}
+
+// recordConfigLoad records the result of loading the metadata configuration.
+func recordConfigLoad(err error) {
+	if err != nil {
+		configReloadsTotal.WithLabelValues("failure").Inc()
+		configLastReloadSuccessful.Set(0)
+		return
+	}
+	configReloadsTotal.WithLabelValues("success").Inc()
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+}
+
+// observeEBSTagRequest records the result of an EC2 tagging request.
+func observeEBSTagRequest(operation string, err error, elapsed time.Duration) {
+	ebsTagRequestDuration.WithLabelValues(operation).Observe(elapsed.Seconds())
+	if err != nil {
+		ebsTagRequestsTotal.WithLabelValues(operation, "failure", awsErrorCode(err)).Inc()
+		return
+	}
+	ebsTagRequestsTotal.WithLabelValues(operation, "success", "").Inc()
+}
+
+// startMetricsServer starts a plain HTTP server exposing the Prometheus metrics
+// along with the liveness and readiness endpoints.
+func startMetricsServer(port int, health *healthChecker) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", health.serveHealthz)
+	mux.HandleFunc("/readyz", health.serveReadyz)
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: mux,
+	}
+
+	go func() {
+		klog.Infof("Starting the metrics server on port %d", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("error while serving metrics: %v", err)
+		}
+	}()
+
+	return server
+}
+
+// workqueueMetricsProvider exposes the client-go workqueue metrics of the
+// ebs-tagger controller through the Prometheus default registry.
+type workqueueMetricsProvider struct{}
+
+func (workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return registerWorkqueueMetric(prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "workqueue",
+		Name:        "depth",
+		Help:        "Current depth of the workqueue.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Gauge)
+}
+
+func (workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return registerWorkqueueMetric(prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "workqueue",
+		Name:        "adds_total",
+		Help:        "Total number of adds handled by the workqueue.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Counter)
+}
+
+func (workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return registerWorkqueueMetric(prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "workqueue",
+		Name:        "queue_duration_seconds",
+		Help:        "How long in seconds an item stays in the workqueue before being requested.",
+		ConstLabels: prometheus.Labels{"name": name},
+		Buckets:     prometheus.ExponentialBuckets(10e-9, 10, 10),
+	})).(prometheus.Histogram)
+}
+
+func (workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return registerWorkqueueMetric(prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "workqueue",
+		Name:        "work_duration_seconds",
+		Help:        "How long in seconds processing an item from the workqueue takes.",
+		ConstLabels: prometheus.Labels{"name": name},
+		Buckets:     prometheus.ExponentialBuckets(10e-9, 10, 10),
+	})).(prometheus.Histogram)
+}
+
+func (workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return registerWorkqueueMetric(prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "workqueue",
+		Name:        "unfinished_work_seconds",
+		Help:        "How many seconds of work has been done that is in progress and hasn't been observed by work_duration.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Gauge)
+}
+
+func (workqueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return registerWorkqueueMetric(prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "workqueue",
+		Name:        "longest_running_processor_seconds",
+		Help:        "How many seconds has the longest running processor for the workqueue been running.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Gauge)
+}
+
+func (workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return registerWorkqueueMetric(prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "workqueue",
+		Name:        "retries_total",
+		Help:        "Total number of retries handled by the workqueue.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Counter)
+}
+
+// The deprecated workqueue metrics are not exposed.
+
+func (workqueueMetricsProvider) NewDeprecatedDepthMetric(name string) workqueue.GaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueMetricsProvider) NewDeprecatedAddsMetric(name string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+func (workqueueMetricsProvider) NewDeprecatedLatencyMetric(name string) workqueue.SummaryMetric {
+	return noopMetric{}
+}
+
+func (workqueueMetricsProvider) NewDeprecatedWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return noopMetric{}
+}
+
+func (workqueueMetricsProvider) NewDeprecatedUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueMetricsProvider) NewDeprecatedLongestRunningProcessorMicrosecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueMetricsProvider) NewDeprecatedRetriesMetric(name string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+func registerWorkqueueMetric(c prometheus.Collector) prometheus.Collector {
+	if err := prometheus.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		klog.Errorf("failed to register workqueue metric: %v", err)
+	}
+	return c
+}
+
+type noopMetric struct{}
+
+func (noopMetric) Inc()            {}
+func (noopMetric) Dec()            {}
+func (noopMetric) Set(float64)     {}
+func (noopMetric) Observe(float64) {}
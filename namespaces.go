@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceCache keeps the namespaces in memory, so that the namespace injection label can be
+// checked without an API request per admission.
+type namespaceCache struct {
+	informer cache.SharedIndexInformer
+}
+
+func newNamespaceCache(kubeclientset kubernetes.Interface) *namespaceCache {
+	listwatch := cache.NewListWatchFromClient(kubeclientset.CoreV1().RESTClient(), "namespaces", metav1.NamespaceAll, fields.Everything())
+	return &namespaceCache{
+		informer: cache.NewSharedIndexInformer(
+			listwatch,
+			&corev1.Namespace{},
+			resyncPeriod,
+			cache.Indexers{},
+		),
+	}
+}
+
+func (c *namespaceCache) Run(stopCh <-chan struct{}) {
+	c.informer.Run(stopCh)
+}
+
+// checkCacheSync reports whether the namespace cache has synced.
+func (c *namespaceCache) checkCacheSync() error {
+	if !c.informer.HasSynced() {
+		return fmt.Errorf("namespace cache not synced")
+	}
+	return nil
+}
+
+// labels returns the labels of a namespace, or nil if it is unknown.
+func (c *namespaceCache) labels(namespace string) map[string]string {
+	if c == nil {
+		return nil
+	}
+	obj, exists, err := c.informer.GetIndexer().GetByKey(namespace)
+	if err != nil || !exists {
+		return nil
+	}
+	return obj.(*corev1.Namespace).Labels
+}
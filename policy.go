@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// metadataUpdate holds the labels and annotations to set on an object so that it carries the
+// configured metadata. It is computed the same way for admission requests and for existing
+// objects patched by the backfill and the reconciler.
+type metadataUpdate struct {
+	metadata           *metav1.ObjectMeta
+	annotations        map[string]string
+	labels             map[string]string
+	removedAnnotations []string
+	removedLabels      []string
+	provenance         string
+}
+
+// planMetadataUpdate applies the metadata policy to an object of the given kind, in a namespace
+// with the given labels. It returns a nil update and the skip reason when the object must not be
+// mutated. When removeStale is set,
+// keys previously injected according to the provenance annotation but no longer configured are
+// removed if they still have the injected value, including the ones whose existing value was
+// overwritten; keys changed by users since they were injected are never removed.
+func (c *MetadataConfig) planMetadataUpdate(kind string, metadata *metav1.ObjectMeta, namespaceLabels map[string]string, removeStale bool) (*metadataUpdate, string) {
+	objectConfig, sources := c.metadataSpecFor(kind, metadata.Namespace)
+
+	if required, reason := mutationRequired(c.ignoredNamespaces(), c.namespaceInjectionEnabled(namespaceLabels), objectConfig, metadata); !required {
+		return nil, reason
+	}
+
+	// The provenance of an object being created is not trusted, it may have been copied along
+	// with the rest of the metadata.
+	var previous *provenance
+	if removeStale {
+		previous = parseProvenance(metadata.Annotations[admissionWebhookAnnotationProvenanceKey])
+	}
+
+	overwrite := c.overrideConflicts()
+	provenance := newProvenance(metadata, objectConfig, sources, previous, c.hash, overwrite).String()
+
+	// The status and provenance annotations are owned by the injector and always overwritten.
+	update := &metadataUpdate{
+		metadata: metadata,
+		annotations: changedKeys(metadata.Annotations, map[string]string{
+			admissionWebhookAnnotationStatusKey:     "injected",
+			admissionWebhookAnnotationProvenanceKey: provenance,
+		}, true),
+		provenance: provenance,
+	}
+	for k, v := range changedKeys(metadata.Annotations, objectConfig.Annotations, overwrite) {
+		update.annotations[k] = v
+	}
+	update.labels = changedKeys(metadata.Labels, objectConfig.Labels, overwrite)
+
+	if previous != nil {
+		update.removedAnnotations = staleKeys(metadata.Annotations, previous.Annotations, objectConfig.Annotations)
+		update.removedLabels = staleKeys(metadata.Labels, previous.Labels, objectConfig.Labels)
+	}
+
+	return update, ""
+}
+
+// staleKeys returns the keys of target previously injected or overwritten, but no longer
+// configured, which still have the value set by the injector.
+func staleKeys(target map[string]string, injected map[string]injectedKey, configured map[string]string) []string {
+	var stale []string
+	for key, recorded := range injected {
+		if _, ok := configured[key]; ok {
+			continue
+		}
+		if current, ok := target[key]; ok && current == recorded.Value {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// changedKeys returns the added keys whose value differs from target. When overwrite is false,
+// keys already present in target are left untouched.
+func changedKeys(target map[string]string, added map[string]string, overwrite bool) map[string]string {
+	changed := map[string]string{}
+	for key, value := range added {
+		if existing, ok := target[key]; ok && (existing == value || !overwrite) {
+			continue
+		}
+		changed[key] = value
+	}
+	return changed
+}
+
+// empty reports whether the object already carries the configured metadata.
+func (u *metadataUpdate) empty() bool {
+	return len(u.annotations) == 0 && len(u.labels) == 0 &&
+		len(u.removedAnnotations) == 0 && len(u.removedLabels) == 0
+}
+
+// jsonPatch returns the JSON patch used in admission responses. Only /metadata/labels and
+// /metadata/annotations are ever patched, so the patch is safe on UPDATE for kinds whose
+// spec is immutable.
+func (u *metadataUpdate) jsonPatch() ([]byte, error) {
+	var patch []patchOperation
+	if len(u.annotations) > 0 || len(u.removedAnnotations) > 0 {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: mergeMetadata(u.metadata.Annotations, u.annotations, u.removedAnnotations),
+		})
+	}
+	if len(u.labels) > 0 || len(u.removedLabels) > 0 {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/labels",
+			Value: mergeMetadata(u.metadata.Labels, u.labels, u.removedLabels),
+		})
+	}
+	return json.Marshal(patch)
+}
+
+// mergePatch returns the JSON merge patch used to update existing objects. Only the changed
+// keys are sent, so concurrent changes to other keys are preserved.
+func (u *metadataUpdate) mergePatch() ([]byte, error) {
+	metadata := map[string]interface{}{}
+	if changes := mergePatchChanges(u.annotations, u.removedAnnotations); len(changes) > 0 {
+		metadata["annotations"] = changes
+	}
+	if changes := mergePatchChanges(u.labels, u.removedLabels); len(changes) > 0 {
+		metadata["labels"] = changes
+	}
+	return json.Marshal(map[string]interface{}{"metadata": metadata})
+}
+
+// mergePatchChanges returns the set keys along with the removed ones mapped to null.
+func mergePatchChanges(set map[string]string, removed []string) map[string]interface{} {
+	changes := map[string]interface{}{}
+	for key, value := range set {
+		changes[key] = value
+	}
+	for _, key := range removed {
+		changes[key] = nil
+	}
+	return changes
+}
+
+// patchMetadata applies a merge patch built by mergePatch to an existing object.
+func patchMetadata(clientset kubernetes.Interface, kind string, namespace string, name string, data []byte) error {
+	var err error
+	switch kind {
+	case kindPod:
+		_, err = clientset.CoreV1().Pods(namespace).Patch(name, types.MergePatchType, data)
+	case kindService:
+		_, err = clientset.CoreV1().Services(namespace).Patch(name, types.MergePatchType, data)
+	case kindPersistentVolumeClaim:
+		_, err = clientset.CoreV1().PersistentVolumeClaims(namespace).Patch(name, types.MergePatchType, data)
+	default:
+		err = fmt.Errorf("unsupported kind %q", kind)
+	}
+	return err
+}
+
+// mergeMetadata returns a copy of target with the added keys set and the removed ones deleted.
+func mergeMetadata(target map[string]string, added map[string]string, removed []string) map[string]string {
+	updated := make(map[string]string, len(target)+len(added))
+	for key, value := range target {
+		updated[key] = value
+	}
+	for key, value := range added {
+		updated[key] = value
+	}
+	for _, key := range removed {
+		delete(updated, key)
+	}
+	return updated
+}
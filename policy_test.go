@@ -0,0 +1,247 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPlanMetadataUpdate(t *testing.T) {
+	config := &MetadataConfig{
+		Namespaces: map[string]NamespaceConfig{
+			"*": {
+				Pod: MetadataSpec{
+					Labels: map[string]string{"cost-center": "platform"},
+				},
+			},
+			"team-a": {
+				Pod: MetadataSpec{
+					Annotations: map[string]string{"owner": "team-a"},
+					Labels:      map[string]string{"cost-center": "team-a"},
+				},
+			},
+		},
+		hash: "rev1",
+	}
+	preserve := *config
+	preserve.ConflictPolicy = conflictPolicyPreserve
+
+	tests := []struct {
+		name        string
+		config      *MetadataConfig
+		namespace   string
+		annotations map[string]string
+		labels      map[string]string
+		removeStale bool
+
+		wantSkip        string
+		wantLabels      map[string]string
+		wantAnnotations map[string]string
+	}{
+		{
+			name:            "create injects the configured keys",
+			config:          config,
+			namespace:       "team-a",
+			wantLabels:      map[string]string{"cost-center": "team-a"},
+			wantAnnotations: map[string]string{"owner": "team-a"},
+		},
+		{
+			name:       "defaults apply to namespaces without config",
+			config:     config,
+			namespace:  "team-b",
+			wantLabels: map[string]string{"cost-center": "platform"},
+		},
+		{
+			name:            "override replaces conflicting values",
+			config:          config,
+			namespace:       "team-a",
+			labels:          map[string]string{"cost-center": "other"},
+			wantLabels:      map[string]string{"cost-center": "team-a"},
+			wantAnnotations: map[string]string{"owner": "team-a"},
+		},
+		{
+			name:            "preserve keeps conflicting values",
+			config:          &preserve,
+			namespace:       "team-a",
+			labels:          map[string]string{"cost-center": "other"},
+			wantLabels:      map[string]string{},
+			wantAnnotations: map[string]string{"owner": "team-a"},
+		},
+		{
+			name:      "update restores removed keys",
+			config:    config,
+			namespace: "team-a",
+			annotations: map[string]string{
+				"owner":                                 "team-a",
+				admissionWebhookAnnotationStatusKey:     "injected",
+				admissionWebhookAnnotationProvenanceKey: `{"configHash":"rev1","annotations":{"owner":{"layer":"team-a","value":"team-a"}},"labels":{"cost-center":{"layer":"team-a","value":"team-a"}}}`,
+			},
+			removeStale: true,
+			wantLabels:  map[string]string{"cost-center": "team-a"},
+		},
+		{
+			name:      "update of an up to date object changes nothing",
+			config:    config,
+			namespace: "team-a",
+			annotations: map[string]string{
+				"owner":                                 "team-a",
+				admissionWebhookAnnotationStatusKey:     "injected",
+				admissionWebhookAnnotationProvenanceKey: `{"configHash":"rev1","annotations":{"owner":{"layer":"team-a","value":"team-a"}},"labels":{"cost-center":{"layer":"team-a","value":"team-a"}}}`,
+			},
+			labels:      map[string]string{"cost-center": "team-a"},
+			removeStale: true,
+			wantLabels:  map[string]string{},
+		},
+		{
+			name:      "ignored namespaces are skipped",
+			config:    config,
+			namespace: metav1.NamespaceSystem,
+			wantSkip:  skipReasonIgnoredNamespace,
+		},
+		{
+			name:        "the skip annotation is honored",
+			config:      config,
+			namespace:   "team-a",
+			annotations: map[string]string{admissionWebhookAnnotationInjectKey: "true"},
+			wantSkip:    skipReasonSkipAnnotation,
+		},
+		{
+			name:      "namespaces without config are skipped",
+			config:    &MetadataConfig{Namespaces: map[string]NamespaceConfig{"team-a": {}}},
+			namespace: "team-b",
+			wantSkip:  skipReasonNoConfig,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata := &metav1.ObjectMeta{
+				Name:        "pod",
+				Namespace:   test.namespace,
+				Annotations: test.annotations,
+				Labels:      test.labels,
+			}
+			update, reason := test.config.planMetadataUpdate(kindPod, metadata, nil, test.removeStale)
+			if test.wantSkip != "" {
+				if update != nil || reason != test.wantSkip {
+					t.Fatalf("got update %+v and reason %q, want skip %q", update, reason, test.wantSkip)
+				}
+				return
+			}
+			if update == nil {
+				t.Fatalf("got skip %q, want an update", reason)
+			}
+			if !reflect.DeepEqual(update.labels, test.wantLabels) {
+				t.Errorf("labels = %v, want %v", update.labels, test.wantLabels)
+			}
+			annotations := map[string]string{}
+			for key, value := range update.annotations {
+				if key != admissionWebhookAnnotationStatusKey && key != admissionWebhookAnnotationProvenanceKey {
+					annotations[key] = value
+				}
+			}
+			if test.wantAnnotations == nil {
+				test.wantAnnotations = map[string]string{}
+			}
+			if !reflect.DeepEqual(annotations, test.wantAnnotations) {
+				t.Errorf("annotations = %v, want %v", annotations, test.wantAnnotations)
+			}
+		})
+	}
+}
+
+func TestPlanMetadataUpdateRemovesStaleKeys(t *testing.T) {
+	config := &MetadataConfig{
+		Namespaces: map[string]NamespaceConfig{
+			"*": {Pod: MetadataSpec{Labels: map[string]string{"team": "a"}}},
+		},
+		hash: "rev2",
+	}
+	metadata := &metav1.ObjectMeta{
+		Name:      "pod",
+		Namespace: "default",
+		Annotations: map[string]string{
+			admissionWebhookAnnotationProvenanceKey: `{"configHash":"rev1","labels":{"team":{"layer":"*","value":"a"},"dropped":{"layer":"*","value":"x"},"edited":{"layer":"*","value":"y"}}}`,
+		},
+		Labels: map[string]string{"team": "a", "dropped": "x", "edited": "set-by-user"},
+	}
+
+	update, reason := config.planMetadataUpdate(kindPod, metadata, nil, true)
+	if update == nil {
+		t.Fatalf("got skip %q, want an update", reason)
+	}
+	if want := []string{"dropped"}; !reflect.DeepEqual(update.removedLabels, want) {
+		t.Errorf("removed labels = %v, want %v", update.removedLabels, want)
+	}
+
+	// A value overwritten under the override policy is removed once dropped from the config.
+	overwritten := &metav1.ObjectMeta{
+		Name:      "pod",
+		Namespace: "default",
+		Labels:    map[string]string{"team": "set-by-user"},
+	}
+	created, _ := config.planMetadataUpdate(kindPod, overwritten, nil, false)
+	overwritten.Annotations = mergeMetadata(overwritten.Annotations, created.annotations, nil)
+	overwritten.Labels = mergeMetadata(overwritten.Labels, created.labels, nil)
+	dropped := &MetadataConfig{Namespaces: map[string]NamespaceConfig{"*": {}}, hash: "rev3"}
+	update, _ = dropped.planMetadataUpdate(kindPod, overwritten, nil, true)
+	if want := []string{"team"}; !reflect.DeepEqual(update.removedLabels, want) {
+		t.Errorf("removed overwritten labels = %v, want %v", update.removedLabels, want)
+	}
+
+	// The provenance of an object being created is not trusted.
+	update, _ = config.planMetadataUpdate(kindPod, metadata, nil, false)
+	if len(update.removedLabels) != 0 {
+		t.Errorf("removed labels on create = %v, want none", update.removedLabels)
+	}
+}
+
+func TestPlanMetadataUpdateRecordsOverwrittenKeys(t *testing.T) {
+	config := &MetadataConfig{
+		Namespaces: map[string]NamespaceConfig{
+			"*": {Pod: MetadataSpec{Labels: map[string]string{"cost-center": "platform"}}},
+		},
+		hash: "rev1",
+	}
+	preserve := *config
+	preserve.ConflictPolicy = conflictPolicyPreserve
+
+	tests := []struct {
+		name   string
+		config *MetadataConfig
+		want   map[string]injectedKey
+	}{
+		{
+			name:   "override",
+			config: config,
+			want:   map[string]injectedKey{"cost-center": {Layer: "*", Value: "platform"}},
+		},
+		{
+			name:   "preserve",
+			config: &preserve,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata := &metav1.ObjectMeta{
+				Name:      "pod",
+				Namespace: "default",
+				Labels:    map[string]string{"cost-center": "set-by-user"},
+			}
+			update, reason := test.config.planMetadataUpdate(kindPod, metadata, nil, false)
+			if update == nil {
+				t.Fatalf("got skip %q, want an update", reason)
+			}
+			recorded := parseProvenance(update.provenance)
+			if recorded == nil {
+				t.Fatalf("invalid provenance %q", update.provenance)
+			}
+			if !reflect.DeepEqual(recorded.Labels, test.want) {
+				t.Errorf("provenance labels = %v, want %v", recorded.Labels, test.want)
+			}
+			if annotation := update.annotations[admissionWebhookAnnotationProvenanceKey]; annotation != update.provenance {
+				t.Errorf("provenance annotation %q differs from the audit annotation %q", annotation, update.provenance)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	admissionWebhookAnnotationProvenanceKey = "k8s-metadata-injector.kubernetes.io/provenance"
+
+	auditAnnotationProvenanceKey = "provenance"
+)
+
+// metadataSources records the config layer ("*" or the namespace name) each configured key comes from.
+type metadataSources struct {
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// injectedKey is a key injected by the k8s-metadata-injector: the config layer it comes from
+// and the value it was set to.
+type injectedKey struct {
+	Layer string `json:"layer"`
+	Value string `json:"value"`
+}
+
+// provenance describes which keys of an object were injected by the k8s-metadata-injector,
+// the config layer and value of each one, and the config revision that produced them.
+type provenance struct {
+	ConfigHash  string                 `json:"configHash"`
+	Annotations map[string]injectedKey `json:"annotations,omitempty"`
+	Labels      map[string]injectedKey `json:"labels,omitempty"`
+}
+
+// newProvenance returns the provenance of the metadata injected into an object, given the
+// provenance previously recorded on it, if any. Keys whose existing value is preserved because
+// of the conflict policy are not reported as injected.
+func newProvenance(metadata *metav1.ObjectMeta, objectConfig *MetadataSpec, sources *metadataSources, previous *provenance, configHash string, overwrite bool) *provenance {
+	p := &provenance{ConfigHash: configHash}
+	if objectConfig == nil || sources == nil {
+		return p
+	}
+	if previous == nil {
+		previous = &provenance{}
+	}
+	p.Annotations = injectedKeys(metadata.Annotations, objectConfig.Annotations, sources.Annotations, previous.Annotations, overwrite)
+	p.Labels = injectedKeys(metadata.Labels, objectConfig.Labels, sources.Labels, previous.Labels, overwrite)
+	return p
+}
+
+// injectedKeys returns the configured keys owned by the injector, with the value it sets: the
+// ones missing from the object, the ones previously injected which still have the recorded
+// value, and the ones whose existing value is overwritten. Keys which existed before injection,
+// or were changed since, are not claimed when their value is preserved.
+func injectedKeys(existing map[string]string, configured map[string]string, sources map[string]string, previous map[string]injectedKey, overwrite bool) map[string]injectedKey {
+	injected := map[string]injectedKey{}
+	for key, value := range configured {
+		if current, ok := existing[key]; ok {
+			recorded, owned := previous[key]
+			switch {
+			case owned && recorded.Value == current:
+				// A previously injected key keeps its value when conflicts are preserved.
+				if !overwrite {
+					value = current
+				}
+			case overwrite && current != value:
+				// The existing value is replaced by the configured one.
+			default:
+				continue
+			}
+		}
+		injected[key] = injectedKey{Layer: sources[key], Value: value}
+	}
+	if len(injected) == 0 {
+		return nil
+	}
+	return injected
+}
+
+// parseProvenance decodes a provenance annotation, returning nil if it is missing or invalid.
+func parseProvenance(value string) *provenance {
+	if value == "" {
+		return nil
+	}
+	var p provenance
+	if err := json.Unmarshal([]byte(value), &p); err != nil {
+		return nil
+	}
+	return &p
+}
+
+func (p *provenance) String() string {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/klog"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Reconciler watches the supported kinds and re-patches objects whose injected metadata no
+// longer matches the active configuration, e.g. after a later apply or another controller
+// removed it.
+type Reconciler struct {
+	clientset          kubernetes.Interface
+	configs            *configStore
+	namespaces         *namespaceCache
+	informers          map[string]cache.SharedIndexInformer
+	queue              workqueue.RateLimitingInterface
+	excludedNamespaces map[string]bool
+}
+
+// reconcileTask identifies an object to reconcile.
+type reconcileTask struct {
+	Kind string
+	Key  string
+}
+
+func NewReconciler(kubeclientset kubernetes.Interface, configs *configStore, namespaces *namespaceCache, resyncPeriod time.Duration, excludedNamespaces []string) *Reconciler {
+
+	r := &Reconciler{
+		clientset:          kubeclientset,
+		configs:            configs,
+		namespaces:         namespaces,
+		informers:          map[string]cache.SharedIndexInformer{},
+		queue:              workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "metadata-reconciler"),
+		excludedNamespaces: map[string]bool{},
+	}
+	for _, namespace := range excludedNamespaces {
+		r.excludedNamespaces[namespace] = true
+	}
+
+	objects := map[string]runtime.Object{
+		kindPod:                   &corev1.Pod{},
+		kindService:               &corev1.Service{},
+		kindPersistentVolumeClaim: &corev1.PersistentVolumeClaim{},
+	}
+
+	for _, res := range supportedResources {
+		kind := res.kind
+		listwatch := cache.NewListWatchFromClient(kubeclientset.CoreV1().RESTClient(), res.resource, metav1.NamespaceAll, fields.Everything())
+		informer := cache.NewSharedIndexInformer(
+			listwatch,
+			objects[kind],
+			resyncPeriod,
+			cache.Indexers{},
+		)
+		// Resyncs are delivered as updates, so every object is checked again once per resync
+		// period even if it did not change.
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				r.enqueue(kind, obj)
+			},
+			UpdateFunc: func(old, new interface{}) {
+				r.enqueue(kind, new)
+			},
+		})
+		r.informers[kind] = informer
+	}
+
+	return r
+}
+
+// configChanged enqueues every cached object, to apply a new configuration without waiting for
+// the next resync. It is registered by the caller, as a new reconciler is created each time the
+// leader election is won.
+func (r *Reconciler) configChanged(*MetadataConfig) {
+	for kind, informer := range r.informers {
+		for _, obj := range informer.GetStore().List() {
+			r.enqueue(kind, obj)
+		}
+	}
+}
+
+func (r *Reconciler) enqueue(kind string, obj interface{}) {
+	metadata := objectMeta(obj.(runtime.Object))
+	if metadata == nil || r.excludedNamespaces[metadata.Namespace] {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	r.queue.Add(reconcileTask{
+		Kind: kind,
+		Key:  key,
+	})
+}
+
+func (r *Reconciler) Run(threadiness int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer r.queue.ShutDown()
+
+	klog.Info("Starting metadata reconciler")
+	defer klog.Infof("Shutting down metadata reconciler")
+
+	for _, informer := range r.informers {
+		go informer.Run(stopCh)
+	}
+
+	klog.Info("Waiting for informer caches to sync")
+
+	if !cache.WaitForCacheSync(stopCh, r.HasSynced) {
+		utilruntime.HandleError(fmt.Errorf("failed to wait for reconciler caches to sync"))
+		return
+	}
+
+	klog.Info("Starting workers")
+	for i := 0; i < threadiness; i++ {
+		go wait.Until(r.runWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+}
+
+// HasSynced returns true once the informer caches of all kinds and the namespace cache have
+// synced. Until then, the namespace injection label is unknown and would not be honored.
+func (r *Reconciler) HasSynced() bool {
+	if r.namespaces != nil && !r.namespaces.informer.HasSynced() {
+		return false
+	}
+	for _, informer := range r.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCacheSync reports whether the informer caches of the reconciler have synced.
+func (r *Reconciler) checkCacheSync() error {
+	if !r.HasSynced() {
+		return fmt.Errorf("reconciler informer caches not synced")
+	}
+	return nil
+}
+
+func (r *Reconciler) runWorker() {
+	for r.processNext() {
+	}
+}
+
+func (r *Reconciler) processNext() bool {
+	key, quit := r.queue.Get()
+
+	if quit {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	task := key.(reconcileTask)
+	err := r.process(task)
+	if err == nil {
+		r.queue.Forget(key)
+	} else if r.queue.NumRequeues(key) < maxRetries {
+		klog.Infof("Error reconciling %s %s (will retry): %v", task.Kind, task.Key, err)
+		r.queue.AddRateLimited(key)
+	} else {
+		klog.Errorf("Error reconciling %s %s (giving up): %v", task.Kind, task.Key, err)
+		reconcileErrorsTotal.WithLabelValues(task.Kind).Inc()
+		r.queue.Forget(key)
+		utilruntime.HandleError(err)
+	}
+
+	return true
+}
+
+func (r *Reconciler) process(task reconcileTask) error {
+
+	obj, exists, err := r.informers[task.Kind].GetIndexer().GetByKey(task.Key)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %s by key %q: %v", task.Kind, task.Key, err)
+	}
+	if !exists {
+		return nil
+	}
+
+	// Nothing is reconciled in degraded mode.
+	config := r.configs.Get()
+	if config == nil {
+		return nil
+	}
+
+	metadata := objectMeta(obj.(runtime.Object))
+	update, _ := config.planMetadataUpdate(task.Kind, metadata, r.namespaces.labels(metadata.Namespace), true)
+	if update == nil || update.empty() {
+		return nil
+	}
+
+	reconcileDriftFoundTotal.WithLabelValues(task.Kind).Inc()
+
+	data, err := update.mergePatch()
+	if err != nil {
+		return err
+	}
+
+	err = patchMetadata(r.clientset, task.Kind, metadata.Namespace, metadata.Name, data)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to patch %s %q: %v", task.Kind, task.Key, err)
+	}
+
+	reconcileDriftFixedTotal.WithLabelValues(task.Kind).Inc()
+	klog.Infof("Reconciled metadata drift of %s %q: %s", task.Kind, task.Key, string(data))
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	selfTestResultSuccess = "success"
+	selfTestResultFailure = "failure"
+	selfTestResultSkipped = "skipped"
+
+	// The webhook is only reachable once a replica is ready and part of the Service endpoints,
+	// so the first self-test is retried during selfTestStartupTimeout.
+	selfTestRetryPeriod    = 5 * time.Second
+	selfTestStartupTimeout = 2 * time.Minute
+)
+
+// errSelfTestSkipped is returned when the configuration does not mutate the canary object, so
+// that the webhook path cannot be verified.
+var errSelfTestSkipped = errors.New("self-test skipped")
+
+// selfTester verifies the whole webhook path, i.e. the registration, Service and CA bundle, by
+// creating a canary object with dryRun=All and checking that it comes back with the injected
+// metadata. Nothing is persisted, and the webhook is registered with SideEffects None so the
+// API server calls it for dry-run requests.
+type selfTester struct {
+	clientset  kubernetes.Interface
+	configs    *configStore
+	namespaces *namespaceCache
+	namespace  string
+	kind       string
+
+	mu  sync.RWMutex
+	err error
+}
+
+func newSelfTester(kubeclientset kubernetes.Interface, configs *configStore, namespaces *namespaceCache, namespace string, kind string) (*selfTester, error) {
+	if resourceForKind(kind) == "" {
+		return nil, fmt.Errorf("unsupported self-test kind %q", kind)
+	}
+	return &selfTester{
+		clientset:  kubeclientset,
+		configs:    configs,
+		namespaces: namespaces,
+		namespace:  namespace,
+		kind:       kind,
+		err:        errors.New("self-test not run yet"),
+	}, nil
+}
+
+// Run runs the self-test at startup, then every interval until stopCh is closed. A zero interval
+// only runs it at startup.
+func (t *selfTester) Run(interval time.Duration, stopCh <-chan struct{}) {
+	wait.PollImmediate(selfTestRetryPeriod, selfTestStartupTimeout, func() (bool, error) {
+		select {
+		case <-stopCh:
+			return true, nil
+		default:
+		}
+		err := t.runOnce()
+		return err == nil || err == errSelfTestSkipped, nil
+	})
+	if interval > 0 {
+		wait.Until(func() {
+			t.runOnce()
+		}, interval, stopCh)
+	}
+}
+
+func (t *selfTester) runOnce() error {
+	err := t.test()
+
+	t.mu.Lock()
+	t.err = err
+	t.mu.Unlock()
+
+	selfTestLastRunTimestamp.SetToCurrentTime()
+	switch {
+	case err == nil:
+		klog.V(2).Infof("Webhook self-test succeeded")
+		selfTestRunsTotal.WithLabelValues(selfTestResultSuccess).Inc()
+		selfTestSuccess.Set(1)
+	case err == errSelfTestSkipped:
+		selfTestRunsTotal.WithLabelValues(selfTestResultSkipped).Inc()
+	default:
+		klog.Errorf("Webhook self-test failed: %v", err)
+		selfTestRunsTotal.WithLabelValues(selfTestResultFailure).Inc()
+		selfTestSuccess.Set(0)
+	}
+	return err
+}
+
+func (t *selfTester) test() error {
+	config := t.configs.Get()
+	if config == nil {
+		return errSelfTestSkipped
+	}
+
+	canary, result := canaryObject(t.kind, t.namespace)
+	metadata := objectMeta(canary)
+	update, reason := config.planMetadataUpdate(t.kind, metadata, t.namespaces.labels(t.namespace), false)
+	if update == nil || update.empty() {
+		klog.Infof("Skipping webhook self-test: %s objects in namespace %s are not mutated (%s)", t.kind, t.namespace, reason)
+		return errSelfTestSkipped
+	}
+
+	err := t.clientset.CoreV1().RESTClient().Post().
+		Namespace(t.namespace).
+		Resource(resourceForKind(t.kind)).
+		Param("dryRun", metav1.DryRunAll).
+		Body(canary).
+		Do().
+		Into(result)
+	if err != nil {
+		return fmt.Errorf("failed to create canary %s: %v", t.kind, err)
+	}
+
+	got := objectMeta(result)
+	var missing []string
+	for key, value := range update.annotations {
+		// The provenance depends on the namespace labels seen by the webhook replica that
+		// served the request, only the presence of the other keys is relevant.
+		if key == admissionWebhookAnnotationProvenanceKey {
+			continue
+		}
+		if got.Annotations[key] != value {
+			missing = append(missing, "annotation "+key)
+		}
+	}
+	for key, value := range update.labels {
+		if got.Labels[key] != value {
+			missing = append(missing, "label "+key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("canary %s was not mutated by the webhook, missing %v", t.kind, missing)
+	}
+	return nil
+}
+
+// check reports the result of the last self-test.
+func (t *selfTester) check() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.err == errSelfTestSkipped {
+		return nil
+	}
+	return t.err
+}
+
+// canaryObject returns a minimal valid object of the given kind to create with dryRun=All, and
+// an empty object to decode the result into.
+func canaryObject(kind string, namespace string) (runtime.Object, runtime.Object) {
+	meta := metav1.ObjectMeta{
+		GenerateName: "k8s-metadata-injector-self-test-",
+		Namespace:    namespace,
+	}
+	switch kind {
+	case kindPod:
+		return &corev1.Pod{
+			ObjectMeta: meta,
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name:  "canary",
+					Image: "k8s.gcr.io/pause:3.1",
+				}},
+			},
+		}, &corev1.Pod{}
+	case kindService:
+		return &corev1.Service{
+			ObjectMeta: meta,
+			Spec: corev1.ServiceSpec{
+				Type:  corev1.ServiceTypeClusterIP,
+				Ports: []corev1.ServicePort{{Port: 80}},
+			},
+		}, &corev1.Service{}
+	default:
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: meta,
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: resource.MustParse("1Gi"),
+					},
+				},
+			},
+		}, &corev1.PersistentVolumeClaim{}
+	}
+}
@@ -1,69 +1,120 @@
 package main
 
 import (
-	"reflect"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 
 	"k8s.io/api/admissionregistration/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
 )
 
 const (
 	webhookName = "serve.k8s-metadata-injector.io"
+
+	// namespaceNameLabel is set by the API server on every namespace to its name.
+	namespaceNameLabel = "kubernetes.io/metadata.name"
+
+	// registrationRevisionAnnotation is set on the MutatingWebhookConfiguration and on the
+	// replica Leases to the registration revision of the replica.
+	registrationRevisionAnnotation = "k8s-metadata-injector.kubernetes.io/registration-revision"
+	// desiredHashAnnotation is the hash of the webhooks computed by the injector, and
+	// appliedHashAnnotation the hash of the webhooks as stored by the API server.
+	desiredHashAnnotation = "k8s-metadata-injector.kubernetes.io/desired-hash"
+	appliedHashAnnotation = "k8s-metadata-injector.kubernetes.io/applied-hash"
 )
 
-func (wh *Webhook) selfRegistration(webhookConfigName string) error {
-	client := wh.clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
-	existing, getErr := client.Get(webhookConfigName, metav1.GetOptions{})
-	if getErr != nil && !errors.IsNotFound(getErr) {
-		return getErr
-	}
+// registrationRevision identifies the registration logic of this release: the hash of the
+// webhooks it generates for a reference configuration using every registration setting. It
+// changes whenever a release registers different webhooks for the same configuration.
+var registrationRevision = referenceRegistrationRevision()
 
-	ignorePolicy := v1beta1.Ignore
-	caCert, err := readCertFile(wh.cert.caCertFile)
-	if err != nil {
-		return err
-	}
-	webhook := v1beta1.Webhook{
-		Name: webhookName,
-		Rules: []v1beta1.RuleWithOperations{
-			{
-				Operations: []v1beta1.OperationType{v1beta1.Create},
-				Rule: v1beta1.Rule{
-					APIGroups:   []string{""},
-					APIVersions: []string{"v1"},
-					Resources:   []string{"pods", "services", "persistentvolumeclaims"},
-				},
-			},
-			{
-				Operations: []v1beta1.OperationType{v1beta1.Update},
-				Rule: v1beta1.Rule{
-					APIGroups:   []string{""},
-					APIVersions: []string{"v1"},
-					Resources:   []string{"services", "persistentvolumeclaims"},
-				},
+func referenceRegistrationRevision() string {
+	timeoutSeconds := int32(10)
+	path := webhookPath
+	wh := &Webhook{
+		configs: &configStore{config: &MetadataConfig{
+			InjectionMode:     injectionModeOptIn,
+			IgnoredNamespaces: []string{"ignored"},
+			Operations:        OperationsConfig{Pod: []string{operationCreate}},
+			Registration: RegistrationConfig{
+				FailurePolicy:      "Fail",
+				TimeoutSeconds:     &timeoutSeconds,
+				ReinvocationPolicy: "IfNeeded",
+				NamespaceSelector:  &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+				ObjectSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": "a"}},
+				Tiers: []NamespaceTier{{
+					Name:              "production",
+					NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production"}},
+				}},
 			},
-		},
-		ClientConfig: v1beta1.WebhookClientConfig{
-			Service:  wh.serviceRef,
-			CABundle: caCert,
-		},
-		FailurePolicy: &ignorePolicy,
+		}},
+		serviceRef: &v1beta1.ServiceReference{Namespace: "namespace", Name: "service", Path: &path},
 	}
-	webhooks := []v1beta1.Webhook{webhook}
+	return hashWebhooks(withServerDefaults(wh.webhooks([]byte("ca"))))
+}
 
-	if getErr == nil && existing != nil {
-		// Update case.
-		glog.Info("Updating existing MutatingWebhookConfiguration for the k8s-metadata-injector admission webhook")
-		if !reflect.DeepEqual(webhooks, existing.Webhooks) {
-			existing.Webhooks = webhooks
-			if _, err := client.Update(existing); err != nil {
-				return err
+// selfRegistration creates or updates the MutatingWebhookConfiguration with the desired webhooks
+// and the annotations recording them in a single request, retrying on conflicts with other
+// replicas. Nothing is registered until a valid configuration is loaded.
+func (wh *Webhook) selfRegistration(webhookConfigName string) error {
+	if wh.configs.Get() == nil {
+		glog.Info("No valid metadata configuration loaded, not registering the admission webhook")
+		return nil
+	}
+	client := wh.clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := client.Get(webhookConfigName, metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		webhooks := wh.webhooks(wh.certs.caBundle())
+		desiredHash := hashWebhooks(webhooks)
+		// The API server defaults some fields of the webhooks; they are set the same way so that
+		// the applied hash is the one of the stored webhooks, to detect later edits.
+		webhooks = withServerDefaults(webhooks)
+		appliedHash := hashWebhooks(webhooks)
+
+		if err == nil {
+			// Update case.
+			if revision := existing.Annotations[registrationRevisionAnnotation]; revision != "" && revision != registrationRevision {
+				running, err := wh.revisionRunning(revision)
+				if err != nil {
+					return err
+				}
+				if running {
+					// Replicas of both revisions run during a rollout; the registration is left
+					// to the other ones until they are gone, so that they do not fight over it.
+					glog.Infof("MutatingWebhookConfiguration %s is managed by running replicas of registration revision %s, leaving it untouched", webhookConfigName, revision)
+					wh.registrationQueue.AddAfter(webhookConfigName, replicaLeaseDuration)
+					return nil
+				}
+			}
+			if !registrationDrifted(existing, desiredHash) {
+				return nil
 			}
+			glog.Info("Updating existing MutatingWebhookConfiguration for the k8s-metadata-injector admission webhook")
+			existing.Webhooks = webhooks
+			setRegistrationAnnotations(&existing.ObjectMeta, desiredHash, appliedHash)
+			_, err = client.Update(existing)
+			return err
 		}
-	} else {
+
 		// Create case.
 		glog.Info("Creating a MutatingWebhookConfiguration for the k8s-metadata-injector admission webhook")
 		webhookConfig := &v1beta1.MutatingWebhookConfiguration{
@@ -72,12 +123,314 @@ func (wh *Webhook) selfRegistration(webhookConfigName string) error {
 			},
 			Webhooks: webhooks,
 		}
-		if _, err := client.Create(webhookConfig); err != nil {
-			return err
+		setRegistrationAnnotations(&webhookConfig.ObjectMeta, desiredHash, appliedHash)
+		_, err = client.Create(webhookConfig)
+		if errors.IsAlreadyExists(err) {
+			// Another replica created it first, update it instead.
+			return errors.NewConflict(v1beta1.Resource("mutatingwebhookconfigurations"), webhookConfigName, err)
 		}
+		return err
+	})
+}
+
+// parseWebhookURL parses the URL the API server calls the webhook at when running out of the
+// cluster. The path defaults to the one served by the webhook, and cannot differ from it.
+func parseWebhookURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return nil, fmt.Errorf("webhook URL %q must be an https URL with a host", rawURL)
+	}
+	if u.Path == "" {
+		u.Path = webhookPath
+	}
+	if u.Path != webhookPath {
+		return nil, fmt.Errorf("webhook URL %q must have the path %s", rawURL, webhookPath)
+	}
+	return u, nil
+}
+
+// revisionRunning reports whether other replicas running the given registration revision hold
+// an unexpired replica Lease.
+func (wh *Webhook) revisionRunning(revision string) (bool, error) {
+	if wh.lease == nil {
+		return false, nil
+	}
+	holders, err := wh.lease.otherHolders(revision)
+	return len(holders) > 0, err
+}
+
+// registrationDrifted reports whether a registration was written for other webhooks or by
+// another revision, or edited since.
+func registrationDrifted(existing *v1beta1.MutatingWebhookConfiguration, desiredHash string) bool {
+	annotations := existing.Annotations
+	return annotations[registrationRevisionAnnotation] != registrationRevision ||
+		annotations[desiredHashAnnotation] != desiredHash ||
+		annotations[appliedHashAnnotation] != hashWebhooks(withServerDefaults(existing.Webhooks))
+}
+
+func setRegistrationAnnotations(meta *metav1.ObjectMeta, desiredHash string, appliedHash string) {
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
 	}
+	meta.Annotations[registrationRevisionAnnotation] = registrationRevision
+	meta.Annotations[desiredHashAnnotation] = desiredHash
+	meta.Annotations[appliedHashAnnotation] = appliedHash
+}
 
-	return nil
+// withServerDefaults returns a copy of the webhooks with the fields defaulted by the API server
+// set explicitly. Stored webhooks are defaulted again, as API servers older than the client
+// leave the fields they do not know unset.
+func withServerDefaults(webhooks []v1beta1.MutatingWebhook) []v1beta1.MutatingWebhook {
+	var result []v1beta1.MutatingWebhook
+	for _, webhook := range webhooks {
+		webhook := *webhook.DeepCopy()
+		if webhook.FailurePolicy == nil {
+			policy := v1beta1.Ignore
+			webhook.FailurePolicy = &policy
+		}
+		if webhook.MatchPolicy == nil {
+			policy := v1beta1.Exact
+			webhook.MatchPolicy = &policy
+		}
+		if webhook.NamespaceSelector == nil {
+			webhook.NamespaceSelector = &metav1.LabelSelector{}
+		}
+		if webhook.ObjectSelector == nil {
+			webhook.ObjectSelector = &metav1.LabelSelector{}
+		}
+		if webhook.SideEffects == nil {
+			sideEffects := v1beta1.SideEffectClassUnknown
+			webhook.SideEffects = &sideEffects
+		}
+		if webhook.TimeoutSeconds == nil {
+			timeoutSeconds := int32(30)
+			webhook.TimeoutSeconds = &timeoutSeconds
+		}
+		if len(webhook.AdmissionReviewVersions) == 0 {
+			webhook.AdmissionReviewVersions = []string{v1beta1.SchemeGroupVersion.Version}
+		}
+		if webhook.ReinvocationPolicy == nil {
+			policy := v1beta1.NeverReinvocationPolicy
+			webhook.ReinvocationPolicy = &policy
+		}
+		for i := range webhook.Rules {
+			if webhook.Rules[i].Scope == nil {
+				scope := v1beta1.AllScopes
+				webhook.Rules[i].Scope = &scope
+			}
+		}
+		if service := webhook.ClientConfig.Service; service != nil && service.Port == nil {
+			port := int32(443)
+			service.Port = &port
+		}
+		result = append(result, webhook)
+	}
+	return result
+}
+
+func hashWebhooks(webhooks []v1beta1.MutatingWebhook) string {
+	data, err := json.Marshal(webhooks)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// runRegistrationController watches the MutatingWebhookConfiguration and applies the desired
+// webhooks again whenever it is edited or deleted, until stopCh is closed. Registration
+// requests after a certificate or configuration change are handled by the same queue.
+func (wh *Webhook) runRegistrationController(webhookConfigName string, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer wh.registrationQueue.ShutDown()
+
+	listwatch := cache.NewListWatchFromClient(
+		wh.clientset.AdmissionregistrationV1beta1().RESTClient(),
+		"mutatingwebhookconfigurations",
+		metav1.NamespaceAll,
+		fields.OneTermEqualSelector("metadata.name", webhookConfigName),
+	)
+	informer := cache.NewSharedIndexInformer(
+		listwatch,
+		&v1beta1.MutatingWebhookConfiguration{},
+		resyncPeriod,
+		cache.Indexers{},
+	)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			wh.requestRegistration()
+		},
+		UpdateFunc: func(old, new interface{}) {
+			wh.requestRegistration()
+		},
+		DeleteFunc: func(obj interface{}) {
+			glog.Warningf("MutatingWebhookConfiguration %s was deleted, registering again", webhookConfigName)
+			wh.requestRegistration()
+		},
+	})
+
+	go informer.Run(stopCh)
+	go wait.Until(wh.runRegistrationWorker, time.Second, stopCh)
+
+	<-stopCh
+}
+
+// requestRegistration queues a registration of the webhook, if it is registered.
+func (wh *Webhook) requestRegistration() {
+	wh.mu.RLock()
+	defer wh.mu.RUnlock()
+	if wh.registered {
+		wh.registrationQueue.Add(wh.webhookConfigName)
+	}
+}
+
+func (wh *Webhook) runRegistrationWorker() {
+	for {
+		key, quit := wh.registrationQueue.Get()
+		if quit {
+			return
+		}
+		webhookConfigName := key.(string)
+		err := wh.selfRegistration(webhookConfigName)
+		if err == nil {
+			wh.registrationQueue.Forget(key)
+		} else if wh.registrationQueue.NumRequeues(key) < maxRetries {
+			glog.Infof("Error registering the admission webhook (will retry): %v", err)
+			wh.registrationQueue.AddRateLimited(key)
+		} else {
+			glog.Errorf("Error registering the admission webhook (giving up until the next resync): %v", err)
+			wh.registrationQueue.Forget(key)
+		}
+		wh.registrationQueue.Done(key)
+	}
+}
+
+// webhooks returns the webhook entries to register: one per namespace tier, each with its own
+// namespace selector, failure policy and timeout, and a default entry for all other namespaces.
+// All of them are served by the same handler.
+func (wh *Webhook) webhooks(caCert []byte) []v1beta1.MutatingWebhook {
+	config := wh.configs.Get()
+	var registration RegistrationConfig
+	var ignoredNamespaces []string
+	if config != nil {
+		registration = config.Registration
+		ignoredNamespaces = config.ignoredNamespaces()
+	}
+	reinvocationPolicy := v1beta1.ReinvocationPolicyType(registration.ReinvocationPolicy)
+	if reinvocationPolicy == "" {
+		reinvocationPolicy = v1beta1.NeverReinvocationPolicy
+	}
+
+	newWebhook := func(name string, failurePolicy string, timeoutSeconds *int32, selector *metav1.LabelSelector) v1beta1.MutatingWebhook {
+		// Namespaces where injection is disabled by their label are not sent to the webhook.
+		selector.MatchExpressions = append(selector.MatchExpressions, config.injectionRequirement())
+		policy := v1beta1.FailurePolicyType(failurePolicy)
+		if policy == "" {
+			policy = v1beta1.FailurePolicyType(registration.FailurePolicy)
+		}
+		if policy == "" {
+			policy = v1beta1.Ignore
+		}
+		if timeoutSeconds == nil {
+			timeoutSeconds = registration.TimeoutSeconds
+		}
+		// The webhook has no side effects, which also lets the API server call it for dry-run
+		// requests such as the self-test.
+		sideEffects := v1beta1.SideEffectClassNone
+		return v1beta1.MutatingWebhook{
+			Name:  name,
+			Rules: rules(config),
+			ClientConfig: v1beta1.WebhookClientConfig{
+				URL:      wh.url,
+				Service:  wh.serviceRef,
+				CABundle: caCert,
+			},
+			FailurePolicy:      &policy,
+			NamespaceSelector:  selector,
+			ObjectSelector:     registration.ObjectSelector,
+			TimeoutSeconds:     timeoutSeconds,
+			ReinvocationPolicy: &reinvocationPolicy,
+			SideEffects:        &sideEffects,
+		}
+	}
+
+	var webhooks []v1beta1.MutatingWebhook
+	for _, tier := range registration.Tiers {
+		selector := namespaceSelector(tier.NamespaceSelector, ignoredNamespaces)
+		webhooks = append(webhooks, newWebhook(tier.Name+"."+webhookName, tier.FailurePolicy, tier.TimeoutSeconds, selector))
+	}
+
+	// The namespaces of the tiers are excluded from the default entry, otherwise the API server
+	// would call the webhook twice for them, adding up both timeouts.
+	selector := namespaceSelector(registration.NamespaceSelector, ignoredNamespaces)
+	if exclusion := registration.tierExclusion(); exclusion != nil {
+		selector.MatchExpressions = append(selector.MatchExpressions, *exclusion)
+	}
+	webhooks = append(webhooks, newWebhook(webhookName, "", nil, selector))
+
+	return webhooks
+}
+
+// namespaceSelector returns the given namespace selector excluding the excluded namespaces, so
+// that the API server does not call the webhook for them at all. It relies on the
+// kubernetes.io/metadata.name label set on every namespace by recent API servers; on older
+// clusters NotIn always matches and ignored namespaces are still skipped by the handler.
+func namespaceSelector(selector *metav1.LabelSelector, excluded []string) *metav1.LabelSelector {
+	result := &metav1.LabelSelector{}
+	if selector != nil {
+		result = selector.DeepCopy()
+	}
+	if len(excluded) > 0 {
+		result.MatchExpressions = append(result.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      namespaceNameLabel,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   excluded,
+		})
+	}
+	return result
+}
+
+// rules returns one rule per supported resource with the operations configured for its kind.
+func rules(config *MetadataConfig) []v1beta1.RuleWithOperations {
+	var rules []v1beta1.RuleWithOperations
+	for _, r := range supportedResources {
+		var operations []v1beta1.OperationType
+		for _, operation := range config.operationsFor(r.kind) {
+			operations = append(operations, v1beta1.OperationType(strings.ToUpper(operation)))
+		}
+		rules = append(rules, v1beta1.RuleWithOperations{
+			Operations: operations,
+			Rule: v1beta1.Rule{
+				APIGroups:   []string{""},
+				APIVersions: []string{"v1"},
+				Resources:   []string{r.resource},
+			},
+		})
+	}
+	return rules
+}
+
+// caBundleRegistered reports whether all the webhooks of the registered
+// MutatingWebhookConfiguration trust the given CA certificate. Without a registration, no
+// webhook has to trust it.
+func caBundleRegistered(clientset kubernetes.Interface, webhookConfigName string, caCert []byte) bool {
+	config, err := clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get(webhookConfigName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return true
+	}
+	if err != nil {
+		glog.Errorf("Failed to check the CA bundle of MutatingWebhookConfiguration %s: %v", webhookConfigName, err)
+		return false
+	}
+	for _, webhook := range config.Webhooks {
+		if !bytes.Contains(webhook.ClientConfig.CABundle, caCert) {
+			return false
+		}
+	}
+	return true
 }
 
 func (wh *Webhook) selfDeregistration(webhookConfigName string) error {
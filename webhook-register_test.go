@@ -0,0 +1,242 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/admissionregistration/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector *metav1.LabelSelector
+		excluded []string
+		want     *metav1.LabelSelector
+	}{
+		{
+			name: "nil selector",
+			want: &metav1.LabelSelector{},
+		},
+		{
+			name:     "excluded namespaces",
+			selector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production"}},
+			excluded: []string{"kube-system"},
+			want: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"env": "production"},
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: namespaceNameLabel, Operator: metav1.LabelSelectorOpNotIn, Values: []string{"kube-system"}},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := namespaceSelector(test.selector, test.excluded)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("namespaceSelector() = %+v, want %+v", got, test.want)
+			}
+			if test.selector != nil && len(test.selector.MatchExpressions) != 0 {
+				t.Errorf("namespaceSelector() modified its argument: %+v", test.selector)
+			}
+		})
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	timeout := int32(5)
+	config := &MetadataConfig{
+		InjectionMode: injectionModeOptIn,
+		Registration: RegistrationConfig{
+			FailurePolicy: "Ignore",
+			Tiers: []NamespaceTier{
+				{
+					Name:              "production",
+					NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production"}},
+					FailurePolicy:     "Fail",
+					TimeoutSeconds:    &timeout,
+				},
+				{
+					Name: "staging",
+					NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"staging", "qa"}},
+					}},
+				},
+			},
+		},
+	}
+	wh := &Webhook{
+		configs:    &configStore{config: config},
+		serviceRef: &v1beta1.ServiceReference{Namespace: "kube-system", Name: "k8s-metadata-injector"},
+	}
+
+	webhooks := wh.webhooks([]byte("ca"))
+	if len(webhooks) != 3 {
+		t.Fatalf("got %d webhooks, want 3", len(webhooks))
+	}
+
+	injection := metav1.LabelSelectorRequirement{Key: namespaceInjectionLabel, Operator: metav1.LabelSelectorOpIn, Values: []string{injectionEnabled}}
+	ignored := metav1.LabelSelectorRequirement{Key: namespaceNameLabel, Operator: metav1.LabelSelectorOpNotIn, Values: config.ignoredNamespaces()}
+	tests := []struct {
+		name          string
+		failurePolicy v1beta1.FailurePolicyType
+		timeout       *int32
+		selector      *metav1.LabelSelector
+	}{
+		{
+			name:          "production." + webhookName,
+			failurePolicy: v1beta1.Fail,
+			timeout:       &timeout,
+			selector: &metav1.LabelSelector{
+				MatchLabels:      map[string]string{"env": "production"},
+				MatchExpressions: []metav1.LabelSelectorRequirement{ignored, injection},
+			},
+		},
+		{
+			name:          "staging." + webhookName,
+			failurePolicy: v1beta1.Ignore,
+			selector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"staging", "qa"}},
+					ignored,
+					injection,
+				},
+			},
+		},
+		{
+			name:          webhookName,
+			failurePolicy: v1beta1.Ignore,
+			selector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					ignored,
+					{Key: "env", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"production", "staging", "qa"}},
+					injection,
+				},
+			},
+		},
+	}
+	for i, test := range tests {
+		webhook := webhooks[i]
+		if webhook.Name != test.name {
+			t.Errorf("webhooks[%d].Name = %s, want %s", i, webhook.Name, test.name)
+		}
+		if *webhook.FailurePolicy != test.failurePolicy {
+			t.Errorf("%s: failure policy %s, want %s", test.name, *webhook.FailurePolicy, test.failurePolicy)
+		}
+		if !reflect.DeepEqual(webhook.TimeoutSeconds, test.timeout) {
+			t.Errorf("%s: timeout %v, want %v", test.name, webhook.TimeoutSeconds, test.timeout)
+		}
+		if !reflect.DeepEqual(webhook.NamespaceSelector, test.selector) {
+			t.Errorf("%s: namespace selector %+v, want %+v", test.name, webhook.NamespaceSelector, test.selector)
+		}
+		if string(webhook.ClientConfig.CABundle) != "ca" || webhook.ClientConfig.Service != wh.serviceRef {
+			t.Errorf("%s: unexpected client config %+v", test.name, webhook.ClientConfig)
+		}
+	}
+}
+
+func TestWithServerDefaults(t *testing.T) {
+	policy := v1beta1.Fail
+	webhooks := []v1beta1.MutatingWebhook{{
+		Name:          webhookName,
+		FailurePolicy: &policy,
+		Rules:         []v1beta1.RuleWithOperations{{Rule: v1beta1.Rule{Resources: []string{"pods"}}}},
+		ClientConfig: v1beta1.WebhookClientConfig{
+			Service: &v1beta1.ServiceReference{Namespace: "kube-system", Name: "k8s-metadata-injector"},
+		},
+	}}
+
+	defaulted := withServerDefaults(webhooks)
+	webhook := defaulted[0]
+	if *webhook.FailurePolicy != v1beta1.Fail {
+		t.Errorf("failure policy %s, want the configured %s", *webhook.FailurePolicy, v1beta1.Fail)
+	}
+	if *webhook.MatchPolicy != v1beta1.Exact || *webhook.SideEffects != v1beta1.SideEffectClassUnknown ||
+		*webhook.TimeoutSeconds != 30 || *webhook.ReinvocationPolicy != v1beta1.NeverReinvocationPolicy {
+		t.Errorf("unexpected defaults %+v", webhook)
+	}
+	if webhook.NamespaceSelector == nil || webhook.ObjectSelector == nil {
+		t.Errorf("selectors not defaulted: %+v", webhook)
+	}
+	if *webhook.Rules[0].Scope != v1beta1.AllScopes || *webhook.ClientConfig.Service.Port != 443 {
+		t.Errorf("rule scope or service port not defaulted: %+v", webhook)
+	}
+	if !reflect.DeepEqual(webhook.AdmissionReviewVersions, []string{"v1beta1"}) {
+		t.Errorf("admission review versions %v, want [v1beta1]", webhook.AdmissionReviewVersions)
+	}
+
+	if webhooks[0].MatchPolicy != nil || webhooks[0].Rules[0].Scope != nil || webhooks[0].ClientConfig.Service.Port != nil {
+		t.Errorf("withServerDefaults() modified its argument: %+v", webhooks[0])
+	}
+	if hashWebhooks(withServerDefaults(defaulted)) != hashWebhooks(defaulted) {
+		t.Error("defaulting the defaulted webhooks changed them")
+	}
+}
+
+func TestRegistrationDrifted(t *testing.T) {
+	webhooks := []v1beta1.MutatingWebhook{{Name: webhookName}}
+	desiredHash := hashWebhooks(webhooks)
+	registered := func(edit func(*v1beta1.MutatingWebhookConfiguration)) *v1beta1.MutatingWebhookConfiguration {
+		config := &v1beta1.MutatingWebhookConfiguration{Webhooks: withServerDefaults(webhooks)}
+		setRegistrationAnnotations(&config.ObjectMeta, desiredHash, hashWebhooks(config.Webhooks))
+		if edit != nil {
+			edit(config)
+		}
+		return config
+	}
+
+	tests := []struct {
+		name        string
+		existing    *v1beta1.MutatingWebhookConfiguration
+		desiredHash string
+		want        bool
+	}{
+		{
+			name:        "up to date",
+			existing:    registered(nil),
+			desiredHash: desiredHash,
+		},
+		{
+			name:        "stored without the defaulted fields",
+			existing:    registered(func(c *v1beta1.MutatingWebhookConfiguration) { c.Webhooks = webhooks }),
+			desiredHash: desiredHash,
+		},
+		{
+			name:        "other desired webhooks",
+			existing:    registered(nil),
+			desiredHash: "other",
+			want:        true,
+		},
+		{
+			name: "edited",
+			existing: registered(func(c *v1beta1.MutatingWebhookConfiguration) {
+				policy := v1beta1.Fail
+				c.Webhooks[0].FailurePolicy = &policy
+			}),
+			desiredHash: desiredHash,
+			want:        true,
+		},
+		{
+			name: "other registration revision",
+			existing: registered(func(c *v1beta1.MutatingWebhookConfiguration) {
+				c.Annotations[registrationRevisionAnnotation] = "other"
+			}),
+			desiredHash: desiredHash,
+			want:        true,
+		},
+		{
+			name:        "not annotated",
+			existing:    &v1beta1.MutatingWebhookConfiguration{Webhooks: withServerDefaults(webhooks)},
+			desiredHash: desiredHash,
+			want:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := registrationDrifted(test.existing, test.desiredHash); got != test.want {
+				t.Errorf("registrationDrifted() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
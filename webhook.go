@@ -2,23 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"path/filepath"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	"k8s.io/api/admissionregistration/v1beta1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/workqueue"
 	//admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/wait"
 	//"k8s.io/kubernetes/pkg/apis/core/v1"
 )
 
@@ -37,17 +45,30 @@ const (
 	admissionWebhookAnnotationInjectKey = "k8s-metadata-injector.kubernetes.io/skip"
 	admissionWebhookAnnotationStatusKey = "k8s-metadata-injector.kubernetes.io/status"
 
+	webhookPath = "/serve"
+
 	serverCertFile = "server-cert.pem"
 	serverKeyFile  = "server-key.pem"
 	caCertFile     = "ca-cert.pem"
 )
 
 type Webhook struct {
-	clientset      kubernetes.Interface
-	server         *http.Server
-	cert           *certBundle
-	serviceRef     *v1beta1.ServiceReference
-	metadataConfig *MetadataConfig
+	clientset  kubernetes.Interface
+	server     *http.Server
+	certs      *certReloader
+	serviceRef *v1beta1.ServiceReference
+	url        *string
+	configs    *configStore
+	namespaces *namespaceCache
+
+	registrationQueue workqueue.RateLimitingInterface
+	stopCh            chan struct{}
+	deregisterPolicy  string
+	lease             *replicaLease
+
+	mu                sync.RWMutex
+	registered        bool
+	webhookConfigName string
 }
 
 type patchOperation struct {
@@ -58,38 +79,40 @@ type patchOperation struct {
 
 func NewWebhook(
 	clientset kubernetes.Interface,
-	certDir string,
+	certs *certReloader,
+	tlsOptions *tlsOptions,
 	webhookServiceNamespace string,
 	webhookServiceName string,
 	webhookPort int,
-	metadataConfig *MetadataConfig) (*Webhook, error) {
-
-    metadataConfig.IgnoredNamespaces = append(metadataConfig.IgnoredNamespaces, defaultIgnoredNamespaces...)
+	configs *configStore,
+	namespaces *namespaceCache) (*Webhook, error) {
 
-	cert := &certBundle{
-		serverCertFile: filepath.Join(certDir, serverCertFile),
-		serverKeyFile:  filepath.Join(certDir, serverKeyFile),
-		caCertFile:     filepath.Join(certDir, caCertFile),
-	}
-	path := "/serve"
+	path := webhookPath
 	serviceRef := &v1beta1.ServiceReference{
 		Namespace: webhookServiceNamespace,
 		Name:      webhookServiceName,
 		Path:      &path,
 	}
 	hook := &Webhook{
-		clientset:      clientset,
-		cert:           cert,
-		serviceRef:     serviceRef,
-		metadataConfig: metadataConfig,
+		clientset:  clientset,
+		certs:      certs,
+		serviceRef: serviceRef,
+		configs:    configs,
+		namespaces: namespaces,
+
+		registrationQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "webhook-registration"),
+		stopCh:            make(chan struct{}),
+		deregisterPolicy:  deregisterNever,
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc(path, hook.serve)
-	tlsConfig, err := configServerTLS(cert)
+	tlsConfig, err := configServerTLS(certs, tlsOptions)
 	if err != nil {
 		return nil, err
 	}
+	certs.OnCAChange(hook.caBundleChanged)
+	configs.OnChange(hook.configChanged)
 	hook.server = &http.Server{
 		Addr:      fmt.Sprintf(":%d", webhookPort),
 		Handler:   mux,
@@ -99,31 +122,177 @@ func NewWebhook(
 	return hook, nil
 }
 
-// Start starts the admission webhook server and registers itself to the API server.
+// SetURL registers the webhook with a URL instead of the Service, for running out of the cluster.
+func (wh *Webhook) SetURL(u *url.URL) {
+	webhookURL := u.String()
+	wh.url = &webhookURL
+	wh.serviceRef = nil
+}
+
+// SetDeregisterPolicy sets when the webhook is deregistered on exit. The replica lease is held
+// while the webhook is registered, whatever the policy, to tell the replicas of other
+// registration revisions that this one is running.
+func (wh *Webhook) SetDeregisterPolicy(policy string, lease *replicaLease) {
+	wh.deregisterPolicy = policy
+	wh.lease = lease
+}
+
+// Start starts the admission webhook server and registers itself to the API server once the
+// server accepts TLS connections, so that the API server never calls a webhook not serving yet.
 func (wh *Webhook) Start(webhookConfigName string) error {
+	listener, err := net.Listen("tcp", wh.server.Addr)
+	if err != nil {
+		return err
+	}
 	go func() {
 		glog.Info("Starting the k8s-metadata-injector admission webhook server")
-		if err := wh.server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		if err := wh.server.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
 			glog.Errorf("error while serving the k8s-metadata-injector admission webhook: %v\n", err)
 		}
 	}()
 
-	return wh.selfRegistration(webhookConfigName)
+	if err := waitForServing(listener.Addr().String()); err != nil {
+		return err
+	}
+
+	if wh.lease != nil {
+		if err := wh.lease.renew(); err != nil {
+			return fmt.Errorf("failed to acquire replica Lease: %v", err)
+		}
+		go wh.lease.Run(wh.stopCh)
+	}
+
+	if err := wh.selfRegistration(webhookConfigName); err != nil {
+		return err
+	}
+
+	wh.mu.Lock()
+	wh.registered = true
+	wh.webhookConfigName = webhookConfigName
+	wh.mu.Unlock()
+
+	go wh.runRegistrationController(webhookConfigName, wh.stopCh)
+	return nil
 }
 
-// Stop deregisters itself with the API server and stops the admission webhook server.
-func (wh *Webhook) Stop(webhookConfigName string) error {
-	// Deregistration will be disabled for high available mode
-	/*if err := wh.selfDeregistration(webhookConfigName); err != nil {
+// waitForServing waits until the server listening on addr presents its certificate in a TLS
+// handshake. The handshake itself fails when client certificates are required.
+func waitForServing(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
 		return err
 	}
-	glog.Infof("Webhook %s deregistered", webhookConfigName)*/
+	dialer := &net.Dialer{Timeout: time.Second}
+	return wait.PollImmediate(100*time.Millisecond, 10*time.Second, func() (bool, error) {
+		served := false
+		conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort("localhost", port), &tls.Config{
+			// Only the handshake matters here, the API server verifies the certificate.
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+				served = true
+				return nil
+			},
+		})
+		if err == nil {
+			conn.Close()
+		}
+		if !served {
+			glog.V(2).Infof("Waiting for the webhook server to accept connections: %v", err)
+		}
+		return served, nil
+	})
+}
+
+// caBundleChanged updates the CA bundle of the registered webhook after the CA certificate
+// was rotated, so that the API server keeps trusting the server certificate.
+func (wh *Webhook) caBundleChanged(caCert []byte) {
+	glog.Info("Updating the CA bundle of the k8s-metadata-injector admission webhook")
+	wh.requestRegistration()
+}
+
+// configChanged registers the webhook again after the metadata configuration changed, as the
+// registration depends on it.
+func (wh *Webhook) configChanged(config *MetadataConfig) {
+	glog.Infof("Updating the registration of the k8s-metadata-injector admission webhook for configuration revision %s", config.hash)
+	wh.requestRegistration()
+}
+
+// checkCertificate reports whether the webhook server has a valid serving certificate loaded.
+func (wh *Webhook) checkCertificate() error {
+	return wh.certs.check()
+}
+
+// checkConfig reports whether a valid metadata configuration is loaded.
+func (wh *Webhook) checkConfig() error {
+	return wh.configs.check()
+}
+
+// checkRegistration reports whether the webhook has been registered to the API server.
+func (wh *Webhook) checkRegistration() error {
+	wh.mu.RLock()
+	defer wh.mu.RUnlock()
+	if !wh.registered {
+		return errors.New("webhook not registered")
+	}
+	if wh.configs.Get() == nil {
+		return errors.New("webhook not registered: no valid configuration loaded")
+	}
+	return nil
+}
+
+// Stop deregisters itself with the API server according to the deregister policy and stops
+// the admission webhook server.
+func (wh *Webhook) Stop(webhookConfigName string) error {
+	// Stop watching the registration first, so that it is not applied again once deleted.
+	close(wh.stopCh)
+
+	if wh.shouldDeregister() {
+		wh.mu.Lock()
+		wh.registered = false
+		wh.mu.Unlock()
+		if err := wh.selfDeregistration(webhookConfigName); err != nil && !apierrors.IsNotFound(err) {
+			glog.Errorf("Failed to deregister webhook %s: %v", webhookConfigName, err)
+		} else {
+			glog.Infof("Webhook %s deregistered", webhookConfigName)
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	glog.Info("Stopping the k8s-metadata-injector admission webhook server")
 	return wh.server.Shutdown(ctx)
 }
 
+// shouldDeregister reports whether the webhook has to be deregistered on exit. With several
+// replicas, the webhook is only deregistered by the last one, so that a rolling update or a
+// scale down never leaves the remaining replicas unregistered.
+func (wh *Webhook) shouldDeregister() bool {
+	if wh.lease != nil {
+		if err := wh.lease.release(); err != nil {
+			glog.Errorf("Failed to release replica Lease: %v", err)
+		}
+	}
+	switch wh.deregisterPolicy {
+	case deregisterAlways:
+		return true
+	case deregisterLastReplica:
+		if wh.lease == nil {
+			return false
+		}
+		holders, err := wh.lease.otherHolders("")
+		if err != nil {
+			glog.Errorf("Failed to list replica Leases, keeping the webhook registered: %v", err)
+			return false
+		}
+		if len(holders) > 0 {
+			glog.Infof("Keeping the webhook registered for the other replicas %v", holders)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
 func (wh *Webhook) serve(w http.ResponseWriter, r *http.Request) {
 	glog.V(2).Info("Serving admission request")
 	var body []byte
@@ -156,13 +325,16 @@ func (wh *Webhook) serve(w http.ResponseWriter, r *http.Request) {
 	ar := admissionv1beta1.AdmissionReview{}
 	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
 		glog.Errorf("Can't decode body: %v", err)
+		admissionDecodeFailuresTotal.WithLabelValues("AdmissionReview").Inc()
 		admissionResponse = &admissionv1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
 		}
 	} else {
+		start := time.Now()
 		admissionResponse = wh.mutate(&ar)
+		observeAdmission(ar.Request, admissionResponse, time.Since(start))
 	}
 
 	admissionReview := admissionv1beta1.AdmissionReview{}
@@ -190,114 +362,79 @@ func (wh *Webhook) mutate(ar *admissionv1beta1.AdmissionReview) *admissionv1beta
 
 	req := ar.Request
 
-	var objectConfig *MetadataSpec
 	var metadata *metav1.ObjectMeta
 
-	if req.Kind.Kind == "Pod" {
-
+	switch req.Kind.Kind {
+	case kindPod:
 		var pod corev1.Pod
 		if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &admissionv1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+			return decodeFailure(req, err)
 		}
-
 		metadata = &pod.ObjectMeta
-		// Deal with potential empty fields, e.g., when the pod is created by a deployment
-		//podName := potentialPodName(&pod.ObjectMeta)
-		if metadata.Namespace == "" {
-			metadata.Namespace = req.Namespace
-		}
-
-		if namespaceConfig, ok := wh.metadataConfig.Namespaces[metadata.Namespace]; ok {
-			objectConfig = &namespaceConfig.Pod
-			if defaultConfig, ok := wh.metadataConfig.Namespaces["*"]; ok {
-				objectConfig.MergeMetadataSpec(defaultConfig.Pod)
-			}
-		} else {
-			if defaultConfig, ok := wh.metadataConfig.Namespaces["*"]; ok {
-				objectConfig = &defaultConfig.Pod
-			}
-		}
-
-	} else if req.Kind.Kind == "Service" {
-
+	case kindService:
 		var service corev1.Service
 		if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &admissionv1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+			return decodeFailure(req, err)
 		}
-
 		metadata = &service.ObjectMeta
-		if metadata.Namespace == "" {
-			metadata.Namespace = req.Namespace
-		}
-
-		if namespaceConfig, ok := wh.metadataConfig.Namespaces[metadata.Namespace]; ok {
-			objectConfig = &namespaceConfig.Service
-			if defaultConfig, ok := wh.metadataConfig.Namespaces["*"]; ok {
-				objectConfig.MergeMetadataSpec(defaultConfig.Service)
-			}
-		} else {
-			if defaultConfig, ok := wh.metadataConfig.Namespaces["*"]; ok {
-				objectConfig = &defaultConfig.Service
-			}
-		}
-
-	} else if req.Kind.Kind == "PersistentVolumeClaim" {
-
+	case kindPersistentVolumeClaim:
 		var pvc corev1.PersistentVolumeClaim
 		if err := json.Unmarshal(req.Object.Raw, &pvc); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &admissionv1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+			return decodeFailure(req, err)
 		}
-
 		metadata = &pvc.ObjectMeta
-		if metadata.Namespace == "" {
-			metadata.Namespace = req.Namespace
+	default:
+		return &admissionv1beta1.AdmissionResponse{
+			Allowed: true,
 		}
+	}
 
-		if namespaceConfig, ok := wh.metadataConfig.Namespaces[metadata.Namespace]; ok {
-			objectConfig = &namespaceConfig.PersistentVolumeClaim
-			if defaultConfig, ok := wh.metadataConfig.Namespaces["*"]; ok {
-				objectConfig.MergeMetadataSpec(defaultConfig.PersistentVolumeClaim)
-			}
-		} else {
-			if defaultConfig, ok := wh.metadataConfig.Namespaces["*"]; ok {
-				objectConfig = &defaultConfig.PersistentVolumeClaim
-			}
-		}
+	// Deal with potential empty fields, e.g., when the pod is created by a deployment
+	if metadata.Namespace == "" {
+		metadata.Namespace = req.Namespace
+	}
 
-	} else {
+	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
+		req.Kind, req.Namespace, req.Name, metadata.Name, req.UID, req.Operation, req.UserInfo)
+
+	// In degraded mode, without a valid configuration, every request is allowed unchanged.
+	config := wh.configs.Get()
+	if config == nil {
+		glog.Warningf("Skipping mutation for %s/%s: no valid configuration loaded", metadata.Namespace, metadata.Name)
+		admissionSkipsTotal.WithLabelValues(skipReasonDegraded).Inc()
 		return &admissionv1beta1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
-	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, metadata.Name, req.UID, req.Operation, req.UserInfo)
+	// Subresources such as pods/status never carry metadata changes we care about.
+	if req.SubResource != "" || !config.handlesOperation(req.Kind.Kind, string(req.Operation)) {
+		glog.Infof("Skipping mutation for %s/%s: operation %s%s is not handled", metadata.Namespace, metadata.Name, req.Operation, req.SubResource)
+		admissionSkipsTotal.WithLabelValues(skipReasonOperation).Inc()
+		return &admissionv1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
 
 	// determine whether to perform mutation
-	if !mutationRequired(wh.metadataConfig.IgnoredNamespaces, objectConfig, metadata) {
+	update, reason := config.planMetadataUpdate(req.Kind.Kind, metadata, wh.namespaces.labels(metadata.Namespace), req.Operation == admissionv1beta1.Update)
+	if update == nil {
 		glog.Infof("Skipping mutation for %s/%s due to policy check", metadata.Namespace, metadata.Name)
+		admissionSkipsTotal.WithLabelValues(reason).Inc()
+		return &admissionv1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// On UPDATE the injected metadata is usually still in place.
+	if update.empty() {
+		glog.Infof("Metadata of %s/%s is up to date, no patch needed", metadata.Namespace, metadata.Name)
 		return &admissionv1beta1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
-	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
-	patchBytes, err := createPatch(metadata, objectConfig, annotations)
+	patchBytes, err := update.jsonPatch()
 	if err != nil {
 		return &admissionv1beta1.AdmissionResponse{
 			Result: &metav1.Status{
@@ -314,74 +451,49 @@ func (wh *Webhook) mutate(ar *admissionv1beta1.AdmissionReview) *admissionv1beta
 			pt := admissionv1beta1.PatchTypeJSONPatch
 			return &pt
 		}(),
+		AuditAnnotations: map[string]string{
+			auditAnnotationProvenanceKey: update.provenance,
+		},
 	}
 }
 
-func createPatch(metadata *metav1.ObjectMeta, objectConfig *MetadataSpec, annotations map[string]string) ([]byte, error) {
-	var patch []patchOperation
-
-	if objectConfig != nil {
-		for k, v := range objectConfig.Annotations {
-			annotations[k] = v
-		}
-		patch = append(patch, updateAnnotation(metadata.Annotations, annotations)...)
-		patch = append(patch, updateLabels(metadata.Labels, objectConfig.Labels)...)
-	} else {
-		patch = append(patch, updateAnnotation(metadata.Annotations, annotations)...)
-	}
-
-	return json.Marshal(patch)
-}
-
-func updateAnnotation(target map[string]string, added map[string]string) (patch []patchOperation) {
-
-	if target == nil {
-		target = map[string]string{}
-	}
-
-	for key, value := range added {
-		target[key] = value
+func decodeFailure(req *admissionv1beta1.AdmissionRequest, err error) *admissionv1beta1.AdmissionResponse {
+	glog.Errorf("Could not unmarshal raw object: %v", err)
+	admissionDecodeFailuresTotal.WithLabelValues(req.Kind.Kind).Inc()
+	return &admissionv1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: err.Error(),
+		},
 	}
-
-	patch = append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/annotations",
-		Value: target,
-	})
-	return patch
 }
 
-func updateLabels(target map[string]string, added map[string]string) (patch []patchOperation) {
-
-	if target == nil {
-		target = map[string]string{}
-	}
-
-	for key, value := range added {
-		target[key] = value
-	}
-
-	patch = append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/labels",
-		Value: target,
-	})
-	return patch
-}
+// mutationRequired reports whether an object has to be mutated, or the reason why it is skipped.
+func mutationRequired(ignoredList []string, namespaceEnabled bool, objectConfig *MetadataSpec, metadata *metav1.ObjectMeta) (bool, string) {
 
-func mutationRequired(ignoredList []string, objectConfig *MetadataSpec, metadata *metav1.ObjectMeta) bool {
-	
 	// skip special kubernete system namespaces
 	for _, namespace := range ignoredList {
 		if metadata.Namespace == namespace {
 			glog.Infof("Skip mutation for %v for it' in special namespace:%v", metadata.Name, metadata.Namespace)
-			return false
+			return false, skipReasonIgnoredNamespace
 		}
 	}
 
+	// skip namespaces where injection is disabled by the namespace label or the injection mode.
+	// They are normally excluded by the namespace selector of the webhook registration already.
+	if !namespaceEnabled {
+		glog.Infof("Skip mutation for %v for injection is disabled in namespace:%v", metadata.Name, metadata.Namespace)
+		return false, skipReasonNamespaceDisabled
+	}
+
 	if objectConfig == nil {
 		glog.Infof("Skip mutation for %v for it is not configured in mutation config:%v", metadata.Name, metadata.Namespace)
-		return false
+		return false, skipReasonNoConfig
+	}
+
+	// objects being deleted only get finalizer updates
+	if metadata.DeletionTimestamp != nil {
+		glog.Infof("Skip mutation for %v/%v for it is being deleted", metadata.Namespace, metadata.Name)
+		return false, skipReasonDeleting
 	}
 
 	annotations := metadata.GetAnnotations()
@@ -393,15 +505,17 @@ func mutationRequired(ignoredList []string, objectConfig *MetadataSpec, metadata
 
 	// determine whether to perform mutation based on annotation for the target resource
 	var required bool
+	var reason string
 	switch strings.ToLower(annotations[admissionWebhookAnnotationInjectKey]) {
 	default:
 		required = true
 	case "y", "yes", "true", "on":
 		required = false
+		reason = skipReasonSkipAnnotation
 	}
 
 	glog.Infof("Mutation policy for %v/%v: status: %q required:%v", metadata.Namespace, metadata.Name, status, required)
-	return required
+	return required, reason
 }
 
 func potentialPodName(metadata *metav1.ObjectMeta) string {
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestMutateOperations(t *testing.T) {
+	wh := &Webhook{
+		configs: &configStore{config: &MetadataConfig{
+			Namespaces: map[string]NamespaceConfig{
+				"*": {Pod: MetadataSpec{Labels: map[string]string{"cost-center": "platform"}}},
+			},
+			Operations: OperationsConfig{Pod: []string{operationCreate}},
+		}},
+	}
+	pod, err := json.Marshal(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		operation   admissionv1beta1.Operation
+		subResource string
+		wantPatch   bool
+	}{
+		{name: "create", operation: admissionv1beta1.Create, wantPatch: true},
+		{name: "update not configured", operation: admissionv1beta1.Update},
+		{name: "delete", operation: admissionv1beta1.Delete},
+		{name: "subresource", operation: admissionv1beta1.Create, subResource: "binding"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := wh.mutate(&admissionv1beta1.AdmissionReview{
+				Request: &admissionv1beta1.AdmissionRequest{
+					Kind:        metav1.GroupVersionKind{Version: "v1", Kind: kindPod},
+					Namespace:   "default",
+					Operation:   test.operation,
+					SubResource: test.subResource,
+					Object:      runtime.RawExtension{Raw: pod},
+				},
+			})
+			if !response.Allowed {
+				t.Fatalf("request denied: %v", response.Result)
+			}
+			if patched := len(response.Patch) > 0; patched != test.wantPatch {
+				t.Errorf("patched = %v, want %v", patched, test.wantPatch)
+			}
+		})
+	}
+}